@@ -0,0 +1,170 @@
+package spqex
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Framings of the queries passed to one run of the command in batch mode.
+const (
+	// BatchNUL terminates each query and each output with a NUL byte. The
+	// outputs are in the order of the queries.
+	BatchNUL = "nul"
+	// BatchJSONLines writes each query as a line of JSON such as
+	// {"id":0,"sql":"SELECT 1"}, and reads each output as a line such as
+	// {"id":0,"sql":"SELECT\n  1"} or {"id":0,"error":"syntax error"}.
+	BatchJSONLines = "jsonl"
+)
+
+// batchQuery is a line of JSON passed to the command in BatchJSONLines.
+type batchQuery struct {
+	ID  int    `json:"id"`
+	SQL string `json:"sql"`
+}
+
+// batchOutput is a line of JSON output by the command in BatchJSONLines.
+type batchOutput struct {
+	ID    int    `json:"id"`
+	SQL   string `json:"sql"`
+	Error string `json:"error"`
+}
+
+// chunkJobs splits jobs into chunks of size, or into n chunks of about the
+// same size if size is not positive, so that each worker runs the command
+// once.
+func chunkJobs(jobs []*commandJob, size, n int) [][]*commandJob {
+	if size <= 0 {
+		size = (len(jobs) + n - 1) / max(n, 1)
+	}
+	chunks := make([][]*commandJob, 0)
+	for len(jobs) > 0 {
+		end := min(size, len(jobs))
+		chunks = append(chunks, jobs[:end])
+		jobs = jobs[end:]
+	}
+	return chunks
+}
+
+// runBatch runs the command once for the queries of jobs framed with
+// opts.Batch. If the command fails or its output cannot be mapped back to
+// the queries, each query is run by itself instead, unless ctx is canceled.
+// If the command times out, all the queries are reported as timed out, so
+// that a hanging command is waited for only once.
+func runBatch(ctx context.Context, opts *Options, jobs []*commandJob) {
+	batchCtx, cancel := withTimeout(ctx, opts)
+	err := runBatchCommand(batchCtx, opts.Command, opts.Batch, jobs)
+	timedOut := errors.Is(batchCtx.Err(), context.DeadlineExceeded)
+	cancel()
+	if err == nil {
+		return
+	}
+	if err := ctx.Err(); err != nil {
+		for _, job := range jobs {
+			job.err = err
+		}
+		return
+	}
+	if timedOut {
+		for _, job := range jobs {
+			job.result = &CommandResult{
+				ExitCode: -1,
+				TimedOut: true,
+			}
+		}
+		return
+	}
+	for _, job := range jobs {
+		jobCtx, cancel := withTimeout(ctx, opts)
+		job.result, job.err = RunCommand(jobCtx, opts.Command, job.query)
+		cancel()
+	}
+}
+
+// runBatchCommand runs the command once for the queries of jobs and sets
+// their results.
+func runBatchCommand(ctx context.Context, command, framing string, jobs []*commandJob) error {
+	var input bytes.Buffer
+	for i, job := range jobs {
+		switch framing {
+		case BatchNUL:
+			input.WriteString(job.query)
+			input.WriteByte(0)
+		case BatchJSONLines:
+			line, err := json.Marshal(&batchQuery{ID: i, SQL: job.query})
+			if err != nil {
+				return err
+			}
+			input.Write(line)
+			input.WriteByte('\n')
+		default:
+			return fmt.Errorf("unknown batch framing %q", framing)
+		}
+	}
+
+	cmd := newCommand(ctx, command)
+	cmd.Stdin = &input
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to execute command %q: %v: %s", command, err, stderr.String())
+	}
+
+	results := make([]*CommandResult, len(jobs))
+	switch framing {
+	case BatchNUL:
+		outputs := strings.Split(strings.TrimSuffix(string(output), "\x00"), "\x00")
+		if len(outputs) != len(jobs) {
+			return fmt.Errorf("command %q output %d queries, want %d", command, len(outputs), len(jobs))
+		}
+		for i, output := range outputs {
+			results[i] = &CommandResult{
+				Output:   string(trimNewlines([]byte(output))),
+				ExitCode: 0,
+			}
+		}
+	case BatchJSONLines:
+		scanner := bufio.NewScanner(bytes.NewReader(output))
+		scanner.Buffer(nil, len(output)+1)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			var out batchOutput
+			if err := json.Unmarshal(scanner.Bytes(), &out); err != nil {
+				return fmt.Errorf("failed to decode output of command %q: %v", command, err)
+			}
+			if out.ID < 0 || out.ID >= len(jobs) {
+				return fmt.Errorf("command %q output unknown id %d", command, out.ID)
+			}
+			results[out.ID] = &CommandResult{
+				Output:   string(trimNewlines([]byte(out.SQL))),
+				ExitCode: 0,
+			}
+			if out.Error != "" {
+				results[out.ID] = &CommandResult{
+					Stderr:   out.Error,
+					ExitCode: 1,
+				}
+			}
+		}
+		for i, result := range results {
+			if result == nil {
+				return fmt.Errorf("command %q output no result for id %d", command, i)
+			}
+		}
+	}
+
+	// What the command printed to the standard error is reported once for
+	// the chunk, as it cannot be attributed to one query.
+	jobs[0].chunkStderr = string(trimNewlines(stderr.Bytes()))
+	for i, job := range jobs {
+		job.result = results[i]
+	}
+	return nil
+}
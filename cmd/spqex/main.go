@@ -1,16 +1,43 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/nametake/spqex"
 )
 
 var Version = "dev"
 
+// Exit codes. When several apply, the largest one is used.
+const (
+	// exitOK means that no problem was found.
+	exitOK = 0
+	// exitFindings means that the command reported errors for some SQL.
+	exitFindings = 1
+	// exitUsage means that the flags or arguments are invalid, as with the
+	// flag package.
+	exitUsage = 2
+	// exitUnformatted means that some SQL is not formatted in check mode.
+	exitUnformatted = 3
+	// exitError means that some files could not be read, parsed or written,
+	// or that the command could not be executed or timed out.
+	exitError = 4
+	// exitInterrupted means that spqex was stopped by SIGINT or SIGTERM, as
+	// with shells for SIGINT.
+	exitInterrupted = 130
+)
+
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] directory\n", os.Args[0])
@@ -20,110 +47,338 @@ func init() {
 }
 
 func main() {
-	mode := flag.String("mode", "lint", "Specify mode (lint or fmt). default: lint")
+	mode := flag.String("mode", "lint", "Specify mode (lint, fmt, diff or check). default: lint")
+	diff := flag.Bool("d", false, "Display diffs of fmt mode instead of rewriting files (same as -mode diff)")
+	color := flag.Bool("color", false, "Colorize diffs in diff mode")
 	cmd := flag.String("cmd", "", "Specify command to execute")
+	jobs := flag.Int("j", 0, "Specify the maximum number of commands run at a time (default: GOMAXPROCS)")
+	batch := flag.String("batch", "", "Pass the queries to one run of the command framed as nul or jsonl")
+	batchSize := flag.Int("batch-size", 0, "Specify the number of queries passed to one run of the command in batch mode (default: split evenly between the workers)")
+	timeout := flag.Duration("timeout", 0, "Specify the maximum time a run of the command may take, such as 10s (default: no limit)")
+	server := flag.Bool("server", false, "Keep the command running and send it the queries as JSON requests")
+	expandArgs := flag.Bool("expand-args", false, "Lint SQL once for each constant value of fmt.Sprintf arguments in lint mode")
+	indent := flag.Bool("indent", false, "Indent formatted SQL relative to the surrounding Go code in fmt mode, and remove the indentation before passing SQL to the command")
+	style := &literalStyleFlag{}
+	flag.Var(style, "style", "Specify the style of rewritten string literals in fmt mode as a comma-separated list of raw-single-line, no-leading-newline, indent-closing and keep-kind")
+	dummyValues := dummyValuesFlag{}
+	flag.Var(dummyValues, "dummy", "Specify the dummy value of fmt.Sprintf verbs in lint mode as kind=value (repeatable)")
 	flag.Parse()
 
 	args := flag.Args()
 	if len(args) == 0 {
 		fmt.Println("No directory specified.")
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 	dir := args[0]
 
+	if *diff {
+		*mode = "diff"
+	}
 	switch *mode {
 	case "fmt":
+	case "diff":
+	case "check":
 	case "lint":
 	default:
-		fmt.Println("Invalid mode specified. Valid modes are fmt or lint.")
+		fmt.Println("Invalid mode specified. Valid modes are fmt, diff, check or lint.")
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	switch *batch {
+	case "", spqex.BatchNUL, spqex.BatchJSONLines:
+	default:
+		fmt.Println("Invalid batch framing specified. Valid framings are nul or jsonl.")
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
 	if *cmd == "" {
 		fmt.Println("No command specified.")
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+
+	if *jobs <= 0 {
+		*jobs = runtime.GOMAXPROCS(0)
+	}
+
+	opts := &spqex.Options{
+		Command:     *cmd,
+		Replace:     *mode != "lint",
+		ExpandArgs:  *expandArgs,
+		Jobs:        *jobs,
+		Timeout:     *timeout,
+		Batch:       *batch,
+		BatchSize:   *batchSize,
+		Indent:      *indent,
+		Style:       style.LiteralStyle,
+		DummyValues: dummyValues,
+	}
+	if *server {
+		opts.Server = spqex.NewServer(*cmd, *jobs)
+		opts.Server.Stderr = os.Stderr
 	}
 
-	exitCode, err := run(dir, *cmd, *mode == "fmt")
+	// On SIGINT or SIGTERM, the running commands are killed and the files
+	// not written yet are left as they are.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	exitCode, err := run(ctx, os.Stdout, os.Stderr, dir, *mode, *color, opts)
+	stop()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+		os.Exit(exitError)
 	}
 	os.Exit(exitCode)
 }
 
-type Result struct {
-	index  int
-	file   string
-	result *spqex.ProcessResult
-	err    error
+// dummyValuesFlag is a repeatable flag of kind=value pairs.
+type dummyValuesFlag map[string]string
+
+func (f dummyValuesFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for kind, value := range f {
+		pairs = append(pairs, kind+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
 }
 
-func processWorker(index int, file, cmd string, replace bool, resultChan chan *Result, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (f dummyValuesFlag) Set(s string) error {
+	kind, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("expected kind=value: %q", s)
+	}
+	defaults := spqex.DefaultDummyValues()
+	if _, ok := defaults[kind]; !ok {
+		kinds := make([]string, 0, len(defaults))
+		for kind := range defaults {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		return fmt.Errorf("unknown kind %q, valid kinds are %s", kind, strings.Join(kinds, ", "))
+	}
+	f[kind] = value
+	return nil
+}
+
+// literalStyleFlag is a comma-separated list of literal style options.
+type literalStyleFlag struct {
+	spqex.LiteralStyle
+}
+
+func (f *literalStyleFlag) options() map[string]*bool {
+	return map[string]*bool{
+		"raw-single-line":    &f.RawSingleLine,
+		"no-leading-newline": &f.NoLeadingNewline,
+		"indent-closing":     &f.IndentClosing,
+		"keep-kind":          &f.KeepKind,
+	}
+}
 
-	r, err := spqex.Process(file, cmd, replace)
+func (f *literalStyleFlag) String() string {
+	enabled := make([]string, 0)
+	for name, value := range f.options() {
+		if *value {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return strings.Join(enabled, ",")
+}
 
-	resultChan <- &Result{
-		index:  index,
-		file:   file,
-		result: r,
-		err:    err,
+func (f *literalStyleFlag) Set(s string) error {
+	options := f.options()
+	for _, name := range strings.Split(s, ",") {
+		value, ok := options[strings.TrimSpace(name)]
+		if !ok {
+			names := make([]string, 0, len(options))
+			for name := range options {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("unknown style %q, valid styles are %s", name, strings.Join(names, ", "))
+		}
+		*value = true
 	}
+	return nil
 }
 
-func writeWorker(file string, output []byte, wg *sync.WaitGroup) {
+// writeWorker writes output to file and sets err to the error of the write,
+// unless ctx is done.
+func writeWorker(ctx context.Context, file string, output []byte, err *error, wg *sync.WaitGroup) {
 	defer wg.Done()
-	if err := os.WriteFile(file, output, 0); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to write file %s: %v\n", file, err)
+	if ctx.Err() != nil {
+		return
+	}
+	*err = writeFile(file, output)
+}
+
+// writeFile replaces the content of file with output. output is written to
+// a temporary file in the same directory, which is then renamed to file, so
+// that file is never left truncated.
+func writeFile(file string, output []byte) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".spqex-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(output); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// printDiff prints the diff of the rewrite of a file to w.
+func printDiff(w io.Writer, r *spqex.ProcessResult, color bool) error {
+	source, err := os.ReadFile(r.File)
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %v", r.File, err)
+	}
+	diff := spqex.Diff(r.File, source, r.Output)
+	if color {
+		diff = colorizeDiff(diff)
+	}
+	fmt.Fprint(w, diff)
+	return nil
+}
+
+const (
+	colorReset = "\x1b[0m"
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+// colorizeDiff colors the lines of a unified diff with ANSI escape codes.
+func colorizeDiff(diff string) string {
+	lines := strings.SplitAfter(diff, "\n")
+	for i, line := range lines {
+		var color string
+		switch {
+		case strings.HasPrefix(line, "---"), strings.HasPrefix(line, "+++"):
+			color = colorBold
+		case strings.HasPrefix(line, "@@"):
+			color = colorCyan
+		case strings.HasPrefix(line, "-"):
+			color = colorRed
+		case strings.HasPrefix(line, "+"):
+			color = colorGreen
+		default:
+			continue
+		}
+		text := strings.TrimSuffix(line, "\n")
+		lines[i] = color + text + colorReset + line[len(text):]
 	}
+	return strings.Join(lines, "")
 }
 
-func run(dir string, cmd string, replace bool) (int, error) {
+// run processes the Go files in dir and reports the results to stdout and
+// stderr in order of file name and position. It returns the exit code.
+func run(ctx context.Context, stdout, stderr io.Writer, dir, mode string, color bool, opts *spqex.Options) (int, error) {
+	if opts.Server != nil {
+		defer opts.Server.Close()
+	}
+
 	files, err := spqex.FindGoFiles(dir)
 	if err != nil {
 		return 0, err
 	}
 
-	resultChan := make(chan *Result)
-	resultWg := &sync.WaitGroup{}
-	go func() {
-		resultWg.Wait()
-		close(resultChan)
-	}()
-
-	for i, file := range files {
-		resultWg.Add(1)
-		go processWorker(i, file, cmd, replace, resultChan, resultWg)
+	// The commands are run by a bounded pool of workers, and the results are
+	// reported in order of file name so that the output does not depend on
+	// which command finishes first.
+	results, err := spqex.ProcessFiles(ctx, files, opts)
+	if ctx.Err() != nil {
+		fmt.Fprintln(stderr, "interrupted, no file was rewritten")
+		return exitInterrupted, nil
+	}
+	if err != nil {
+		return 0, err
 	}
+	exitCode := exitOK
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].File < results[j].File
+	})
 
 	writeErrWg := &sync.WaitGroup{}
+	// writeErrs holds the errors of the writes of results, which are
+	// reported after all of them in order of file name.
+	writeErrs := make([]error, len(results))
 
-	exitCode := 0
-	for result := range resultChan {
-		if result.err != nil {
-			fmt.Fprintf(os.Stderr, "failed to process %s: %v\n", result.file, result.err)
+	printedErrors := false
+	for i, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(stderr, "failed to process %s: %v\n", r.File, r.Err)
+			exitCode = max(exitCode, exitError)
 		}
-		code := result.result.ExitCode()
-		if code != 0 {
-			if result.index != 0 {
-				fmt.Fprint(os.Stderr, "\n")
+		for _, warning := range r.Warnings {
+			if warning.PosText == "" {
+				fmt.Fprintf(stderr, "warning: %s\n", warning.Message)
+				continue
 			}
-			fmt.Fprintf(os.Stderr, "%s\n", result.result)
+			fmt.Fprintf(stderr, "%s: warning: %s\n", warning.PosText, warning.Message)
 		}
-		if code > exitCode {
-			exitCode = code
+		if r.ExitCode() != 0 {
+			if printedErrors {
+				fmt.Fprint(stderr, "\n")
+			}
+			fmt.Fprintf(stderr, "%s\n", r)
+			printedErrors = true
+			exitCode = max(exitCode, exitFindings)
+			for _, msg := range r.ErrorMessages {
+				if msg.TimedOut {
+					exitCode = max(exitCode, exitError)
+				}
+			}
 		}
-		if result.result.IsChanged {
-			writeErrWg.Add(1)
-			go writeWorker(result.file, result.result.Output, writeErrWg)
+		if !r.IsChanged {
+			continue
+		}
+		switch mode {
+		case "diff":
+			if err := printDiff(stdout, r, color); err != nil {
+				fmt.Fprintf(stderr, "%v\n", err)
+				exitCode = max(exitCode, exitError)
+			}
+			continue
+		case "check":
+			for _, pos := range r.Unformatted {
+				fmt.Fprintf(stdout, "%s: SQL is not formatted\n", pos)
+			}
+			exitCode = max(exitCode, exitUnformatted)
+			continue
 		}
+		writeErrWg.Add(1)
+		go writeWorker(ctx, r.File, r.Output, &writeErrs[i], writeErrWg)
 	}
 
 	writeErrWg.Wait()
+	for i, err := range writeErrs {
+		if err != nil {
+			fmt.Fprintf(stderr, "failed to write file %s: %v\n", results[i].File, err)
+			exitCode = max(exitCode, exitError)
+		}
+	}
+	if ctx.Err() != nil {
+		fmt.Fprintln(stderr, "interrupted, some files may not have been rewritten")
+		return exitInterrupted, nil
+	}
 
 	return exitCode, nil
 }
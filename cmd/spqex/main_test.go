@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/nametake/spqex"
+)
+
+const (
+	runSourceA = `package a
+
+import "cloud.google.com/go/spanner"
+
+var x = spanner.Statement{SQL: "SELECT * FROM HAS_ERROR;"}
+var y = spanner.Statement{SQL: "SELECT * FROM TABLE;"}
+`
+	runSourceB = `package a
+
+import "cloud.google.com/go/spanner"
+
+var z = spanner.Statement{SQL: "SELECT * FROM TABLE;"}
+`
+	// runCommand replaces TABLE with TABLE_A, and fails for SQL with
+	// HAS_ERROR.
+	runCommand = `sql=$(cat); if [[ $sql == *HAS_ERROR* ]]; then echo -n "COMMAND ERROR" 1>&2; exit 1; fi; echo -n "${sql//TABLE/TABLE_A}"`
+)
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		mode       string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+		wantA      string
+		wantB      string
+	}{
+		{
+			mode:       "lint",
+			wantCode:   exitFindings,
+			wantStdout: "",
+			wantStderr: "a.go:5:32:\nSELECT * FROM HAS_ERROR;\nCOMMAND ERROR\n",
+			wantA:      runSourceA,
+			wantB:      runSourceB,
+		},
+		{
+			mode:       "check",
+			wantCode:   exitUnformatted,
+			wantStdout: "a.go:6:32: SQL is not formatted\nb.go:5:32: SQL is not formatted\n",
+			wantStderr: "a.go:5:32:\nSELECT * FROM HAS_ERROR;\nCOMMAND ERROR\n",
+			wantA:      runSourceA,
+			wantB:      runSourceB,
+		},
+		{
+			mode:     "diff",
+			wantCode: exitFindings,
+			wantStdout: "--- a.go\n+++ a.go\n@@ -3,4 +3,4 @@\n" +
+				" import \"cloud.google.com/go/spanner\"\n \n" +
+				" var x = spanner.Statement{SQL: \"SELECT * FROM HAS_ERROR;\"}\n" +
+				"-var y = spanner.Statement{SQL: \"SELECT * FROM TABLE;\"}\n" +
+				"+var y = spanner.Statement{SQL: \"SELECT * FROM TABLE_A;\"}\n" +
+				"--- b.go\n+++ b.go\n@@ -2,4 +2,4 @@\n \n" +
+				" import \"cloud.google.com/go/spanner\"\n \n" +
+				"-var z = spanner.Statement{SQL: \"SELECT * FROM TABLE;\"}\n" +
+				"+var z = spanner.Statement{SQL: \"SELECT * FROM TABLE_A;\"}\n",
+			wantStderr: "a.go:5:32:\nSELECT * FROM HAS_ERROR;\nCOMMAND ERROR\n",
+			wantA:      runSourceA,
+			wantB:      runSourceB,
+		},
+		{
+			mode:       "fmt",
+			wantCode:   exitFindings,
+			wantStdout: "",
+			wantStderr: "a.go:5:32:\nSELECT * FROM HAS_ERROR;\nCOMMAND ERROR\n",
+			wantA:      strings.Replace(runSourceA, "FROM TABLE;", "FROM TABLE_A;", 1),
+			wantB:      strings.Replace(runSourceB, "FROM TABLE;", "FROM TABLE_A;", 1),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestFile(t, filepath.Join(dir, "a.go"), runSourceA)
+			writeTestFile(t, filepath.Join(dir, "b.go"), runSourceB)
+
+			opts := &spqex.Options{
+				Command: runCommand,
+				Replace: test.mode != "lint",
+				Jobs:    4,
+			}
+			var stdout, stderr bytes.Buffer
+			code, err := run(context.Background(), &stdout, &stderr, dir, test.mode, false, opts)
+			if err != nil {
+				t.Fatalf("run(%q) returned unexpected error: %v", test.mode, err)
+			}
+			if code != test.wantCode {
+				t.Errorf("run(%q) = %d, want %d", test.mode, code, test.wantCode)
+			}
+
+			// The paths are reported relative to the temporary directory.
+			trim := func(s string) string {
+				return strings.ReplaceAll(s, dir+string(filepath.Separator), "")
+			}
+			if diff := cmp.Diff(test.wantStdout, trim(stdout.String())); diff != "" {
+				t.Errorf("run(%q) printed unexpected stdout (-want +got):\n%s", test.mode, diff)
+			}
+			if diff := cmp.Diff(test.wantStderr, trim(stderr.String())); diff != "" {
+				t.Errorf("run(%q) printed unexpected stderr (-want +got):\n%s", test.mode, diff)
+			}
+			for file, want := range map[string]string{"a.go": test.wantA, "b.go": test.wantB} {
+				got, err := os.ReadFile(filepath.Join(dir, file))
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", file, err)
+				}
+				if diff := cmp.Diff(want, string(got)); diff != "" {
+					t.Errorf("run(%q) left unexpected %s (-want +got):\n%s", test.mode, file, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestRunError(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nonexistent")
+	var stdout, stderr bytes.Buffer
+	if _, err := run(context.Background(), &stdout, &stderr, dir, "lint", false, &spqex.Options{Command: "cat"}); err == nil {
+		t.Errorf("run(%q) returned no error, want error", dir)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dir = t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.go"), runSourceA)
+	code, err := run(ctx, &stdout, &stderr, dir, "fmt", false, &spqex.Options{Command: runCommand, Replace: true})
+	if err != nil {
+		t.Fatalf("run(%q) returned unexpected error: %v", dir, err)
+	}
+	if code != exitInterrupted {
+		t.Errorf("run(%q) = %d for a canceled context, want %d", dir, code, exitInterrupted)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "a.go"))
+	if err != nil {
+		t.Fatalf("failed to read a.go: %v", err)
+	}
+	if string(got) != runSourceA {
+		t.Errorf("run(%q) rewrote a.go for a canceled context:\n%s", dir, got)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.go")
+	writeTestFile(t, file, "package a\n")
+	if err := os.Chmod(file, 0o640); err != nil {
+		t.Fatalf("failed to change mode of %s: %v", file, err)
+	}
+
+	if err := writeFile(file, []byte("package b\n")); err != nil {
+		t.Fatalf("writeFile(%q) returned unexpected error: %v", file, err)
+	}
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", file, err)
+	}
+	if want := "package b\n"; string(got) != want {
+		t.Errorf("writeFile(%q) wrote %q, want %q", file, got, want)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %v", file, err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o640 {
+		t.Errorf("writeFile(%q) changed the mode to %v, want %v", file, mode, os.FileMode(0o640))
+	}
+
+	// A failed rename leaves no temporary file.
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatalf("failed to create %s: %v", sub, err)
+	}
+	writeTestFile(t, filepath.Join(sub, "b.go"), "package b\n")
+	if err := writeFile(sub, []byte("package b\n")); err == nil {
+		t.Errorf("writeFile(%q) returned no error, want error", sub)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", dir, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if diff := cmp.Diff([]string{"a.go", "sub"}, names); diff != "" {
+		t.Errorf("writeFile(%q) left unexpected files (-want +got):\n%s", sub, diff)
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
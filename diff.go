@@ -0,0 +1,248 @@
+package spqex
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// diffLine is a line of a diff prefixed with ' ', '-' or '+'.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// Diff returns a unified diff from old to new of the file at path, or an
+// empty string if they are equal. Relative paths are prefixed with a/ and b/
+// as in git diff.
+func Diff(path string, old, new []byte) string {
+	lines := diffLines(splitLines(string(old)), splitLines(string(new)))
+
+	var b strings.Builder
+	// oldLine and newLine are the line numbers at lines[i], counted from 0.
+	oldLine, newLine := 0, 0
+	for i := 0; i < len(lines); {
+		if lines[i].op == ' ' {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		// The hunk starts with the context before the change and ends when
+		// the next change is too far to share the context.
+		start := max(i-diffContext, 0)
+		end := i
+		for end < len(lines) {
+			if lines[end].op != ' ' {
+				end++
+				continue
+			}
+			next := end
+			for next < len(lines) && lines[next].op == ' ' {
+				next++
+			}
+			if next == len(lines) || next-end > 2*diffContext {
+				end = min(end+diffContext, len(lines))
+				break
+			}
+			end = next
+		}
+
+		oldStart, newStart := oldLine-(i-start), newLine-(i-start)
+		oldCount, newCount := 0, 0
+		for _, line := range lines[start:end] {
+			if line.op != '+' {
+				oldCount++
+			}
+			if line.op != '-' {
+				newCount++
+			}
+		}
+
+		if b.Len() == 0 {
+			// As with gofmt -d, absolute paths are not prefixed.
+			if filepath.IsAbs(path) {
+				fmt.Fprintf(&b, "--- %s\n+++ %s\n", path, path)
+			} else {
+				fmt.Fprintf(&b, "--- a/%s\n+++ b/%s\n", path, path)
+			}
+		}
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n", hunkRange(oldStart, oldCount), hunkRange(newStart, newCount))
+		for _, line := range lines[start:end] {
+			b.WriteByte(line.op)
+			b.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		for _, line := range lines[i:end] {
+			if line.op != '+' {
+				oldLine++
+			}
+			if line.op != '-' {
+				newLine++
+			}
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// hunkRange formats the start line, counted from 0, and the number of lines
+// of a hunk as in the header of a unified diff.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits s into lines keeping their newlines.
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns the lines of a shortest edit from a to b, computed
+// with the linear space variant of the algorithm of Myers, "An O(ND)
+// Difference Algorithm and Its Variations". Deleted lines are placed before
+// the inserted lines that replace them.
+func diffLines(a, b []string) []*diffLine {
+	d := &differ{
+		a:     a,
+		b:     b,
+		keepA: make([]bool, len(a)),
+		keepB: make([]bool, len(b)),
+	}
+	n := (len(a)+len(b)+1)/2 + 1
+	d.forward = make([]int, 2*n+1)
+	d.backward = make([]int, 2*n+1)
+	d.compare(0, len(a), 0, len(b))
+
+	lines := make([]*diffLine, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && !d.keepA[i]:
+			lines = append(lines, &diffLine{op: '-', text: a[i]})
+			i++
+		case j < len(b) && !d.keepB[j]:
+			lines = append(lines, &diffLine{op: '+', text: b[j]})
+			j++
+		default:
+			lines = append(lines, &diffLine{op: ' ', text: a[i]})
+			i++
+			j++
+		}
+	}
+	return lines
+}
+
+// differ finds the lines of a and b kept by a shortest edit.
+type differ struct {
+	a, b         []string
+	keepA, keepB []bool
+	// forward and backward hold the furthest reaching paths of the search
+	// from the start and the end, indexed by diagonal.
+	forward, backward []int
+}
+
+// compare marks the lines kept by a shortest edit from a[alo:ahi] to
+// b[blo:bhi]. The edit is split at a middle snake, a run of equal lines on
+// a shortest path, and each part is compared recursively.
+func (d *differ) compare(alo, ahi, blo, bhi int) {
+	for alo < ahi && blo < bhi && d.a[alo] == d.b[blo] {
+		d.keep(alo, blo)
+		alo++
+		blo++
+	}
+	for alo < ahi && blo < bhi && d.a[ahi-1] == d.b[bhi-1] {
+		d.keep(ahi-1, bhi-1)
+		ahi--
+		bhi--
+	}
+	if alo == ahi || blo == bhi {
+		return
+	}
+
+	x1, y1, x2, y2 := d.middleSnake(alo, ahi, blo, bhi)
+	for x, y := x1, y1; x < x2; x, y = x+1, y+1 {
+		d.keep(x, y)
+	}
+	d.compare(alo, x1, blo, y1)
+	d.compare(x2, ahi, y2, bhi)
+}
+
+func (d *differ) keep(x, y int) {
+	d.keepA[x] = true
+	d.keepB[y] = true
+}
+
+// middleSnake returns the start and the end of the middle snake of a
+// shortest edit from a[alo:ahi] to b[blo:bhi], searching from both ends
+// until the paths overlap. The first and last lines of the ranges differ.
+func (d *differ) middleSnake(alo, ahi, blo, bhi int) (int, int, int, int) {
+	n, m := ahi-alo, bhi-blo
+	delta := n - m
+	odd := delta%2 != 0
+	// The paths are indexed by the diagonal k = x - y, offset by the
+	// maximum number of steps so that the indexes are not negative.
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	forward, backward := d.forward, d.backward
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+
+	// The paths overlap after at most maxD steps.
+	for step := 0; ; step++ {
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || (k != step && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && d.a[alo+x] == d.b[blo+y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			// The backward paths count from the end, so the diagonal k
+			// is delta - k for them.
+			if kb := delta - k; odd && kb >= -(step-1) && kb <= step-1 && x+backward[offset+kb] >= n {
+				return alo + x0, blo + y0, alo + x, blo + y
+			}
+		}
+		for k := -step; k <= step; k += 2 {
+			var x int
+			if k == -step || (k != step && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && d.a[ahi-1-x] == d.b[bhi-1-y] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			if kf := delta - k; !odd && kf >= -step && kf <= step && x+forward[offset+kf] >= n {
+				return ahi - x, bhi - y, ahi - x0, bhi - y0
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package spqex
+
+import (
+	"go/types"
+	"regexp"
+	"strings"
+)
+
+// Kinds of dummy values a verb is replaced with in lint mode, depending on
+// where the verb is used in the SQL and the type of its argument.
+const (
+	DummyIdentifier = "identifier"
+	DummyString     = "string"
+	DummyQuoted     = "quoted"
+	DummyNumber     = "number"
+	DummyBool       = "bool"
+	DummyNumberList = "number_list"
+	DummyStringList = "string_list"
+	DummyHint       = "hint"
+)
+
+// DefaultDummyValues returns the dummy value used for each kind unless it
+// is configured with Options.DummyValues.
+func DefaultDummyValues() map[string]string {
+	return map[string]string{
+		DummyIdentifier: "_DUMMY_IDENTIFIER_",
+		DummyString:     "_DUMMY_STRING_",
+		DummyQuoted:     `"_DUMMY_QUOTED_"`,
+		DummyNumber:     "1",
+		DummyBool:       "TRUE",
+		DummyNumberList: "1, 2",
+		DummyStringList: "'_DUMMY_1_', '_DUMMY_2_'",
+		DummyHint:       "FORCE_INDEX=_BASE_TABLE",
+	}
+}
+
+var (
+	inListPattern = regexp.MustCompile(`(?i)\bIN\s*\(\s*$`)
+	hintPattern   = regexp.MustCompile(`@\{\s*$`)
+)
+
+// dummyKind returns the kind of dummy value for a verb from the SQL before
+// it and the type of its argument, which is nil or invalid if unknown.
+func dummyKind(verb rune, before string, typ types.Type) string {
+	if verb == 'q' {
+		return DummyQuoted
+	}
+	// Inside a quoted string literal
+	if strings.Count(before, "'")%2 == 1 || strings.Count(before, `"`)%2 == 1 {
+		return DummyString
+	}
+	if hintPattern.MatchString(before) {
+		return DummyHint
+	}
+
+	var isNumber, isBool, isList bool
+	switch verb {
+	case 'd', 'b', 'o', 'O', 'x', 'X', 'e', 'E', 'f', 'F', 'g', 'G':
+		isNumber = true
+	case 't':
+		isBool = true
+	}
+	if typ != nil {
+		if slice, ok := typ.Underlying().(*types.Slice); ok {
+			isList = true
+			typ = slice.Elem()
+		}
+		// The types of unresolved imports are invalid, and the verb decides
+		// the kind for them.
+		if basic, ok := typ.Underlying().(*types.Basic); ok && basic.Kind() != types.Invalid {
+			isNumber = basic.Info()&types.IsNumeric != 0
+			isBool = basic.Info()&types.IsBoolean != 0
+		}
+	}
+
+	if isList || inListPattern.MatchString(before) {
+		if isNumber {
+			return DummyNumberList
+		}
+		return DummyStringList
+	}
+	switch {
+	case isNumber:
+		return DummyNumber
+	case isBool:
+		return DummyBool
+	}
+	return DummyIdentifier
+}
+
+// dummyValue returns the dummy value for a verb, preferring the configured
+// values over the default ones.
+func dummyValue(values map[string]string, verb rune, before string, typ types.Type) string {
+	kind := dummyKind(verb, before, typ)
+	if value, ok := values[kind]; ok {
+		return value
+	}
+	return DefaultDummyValues()[kind]
+}
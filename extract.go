@@ -0,0 +1,482 @@
+package spqex
+
+import (
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+)
+
+// sqlExpr is an expression holding the SQL of a statement.
+type sqlExpr struct {
+	// slot points to the expression so that it can be replaced by the
+	// rewritten literal in fmt mode. It is nil if the SQL is a constant
+	// expression that cannot be rewritten.
+	slot  *ast.Expr
+	query string
+	pos   token.Pos
+	// isFormat reports whether the SQL is the format string of
+	// fmt.Sprintf.
+	isFormat bool
+	// args holds the constant values each argument of fmt.Sprintf can
+	// take, or nil if they are unknown.
+	args [][]constant.Value
+	// argTypes holds the types of the arguments of fmt.Sprintf.
+	argTypes []types.Type
+}
+
+// textEdit replaces the bytes from start to end of a source with value.
+type textEdit struct {
+	start int
+	end   int
+	value string
+}
+
+// edit returns the edit replacing the expression with a string literal of
+// value.
+func (e *sqlExpr) edit(fset *token.FileSet, value string) textEdit {
+	return textEdit{
+		start: fset.Position((*e.slot).Pos()).Offset,
+		end:   fset.Position((*e.slot).End()).Offset,
+		value: value,
+	}
+}
+
+// applyEdits applies edits, which must not overlap, to source.
+func applyEdits(source []byte, edits []textEdit) []byte {
+	sort.Slice(edits, func(i, j int) bool {
+		return edits[i].start < edits[j].start
+	})
+
+	output := make([]byte, 0, len(source))
+	offset := 0
+	for _, edit := range edits {
+		output = append(output, source[offset:edit.start]...)
+		output = append(output, edit.value...)
+		offset = edit.end
+	}
+	return append(output, source[offset:]...)
+}
+
+// concatStringLits folds a string literal or a chain of string literals
+// joined with the + operator into one string.
+func concatStringLits(expr ast.Expr) (string, bool) {
+	switch expr := expr.(type) {
+	case *ast.BasicLit:
+		if expr.Kind != token.STRING {
+			return "", false
+		}
+		value, err := strconv.Unquote(expr.Value)
+		if err != nil {
+			return "", false
+		}
+		return value, true
+	case *ast.BinaryExpr:
+		if expr.Op != token.ADD {
+			return "", false
+		}
+		x, ok := concatStringLits(expr.X)
+		if !ok {
+			return "", false
+		}
+		y, ok := concatStringLits(expr.Y)
+		if !ok {
+			return "", false
+		}
+		return x + y, true
+	case *ast.ParenExpr:
+		return concatStringLits(expr.X)
+	}
+	return "", false
+}
+
+// extractor finds the SQL of spanner statements in a type checked package.
+type extractor struct {
+	info *types.Info
+	// consts maps constants to their value expression in the declaration.
+	consts map[types.Object]*ast.Expr
+	// vars maps local variables to the last value expression assigned to
+	// them, values holds all the value expressions, and assignments counts
+	// how many times they are assigned, including implicit assignments such
+	// as parameters. zeros holds the variables declared without value.
+	vars        map[types.Object]*ast.Expr
+	values      map[types.Object][]ast.Expr
+	assignments map[types.Object]int
+	zeros       map[types.Object]bool
+	// resolving holds the objects being resolved to break cycles.
+	resolving map[types.Object]bool
+}
+
+func newExtractor(files []*ast.File, info *types.Info) *extractor {
+	x := &extractor{
+		info:        info,
+		consts:      make(map[types.Object]*ast.Expr),
+		vars:        make(map[types.Object]*ast.Expr),
+		values:      make(map[types.Object][]ast.Expr),
+		assignments: make(map[types.Object]int),
+		zeros:       make(map[types.Object]bool),
+		resolving:   make(map[types.Object]bool),
+	}
+	for _, file := range files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.ValueSpec:
+				x.collectValueSpec(n)
+			case *ast.AssignStmt:
+				x.collectAssignStmt(n)
+			case *ast.FuncDecl:
+				x.collectFields(n.Recv)
+			case *ast.FuncType:
+				// Parameters and results hold the values passed by the
+				// caller or returned.
+				x.collectFields(n.Params)
+				x.collectFields(n.Results)
+			case *ast.RangeStmt:
+				for _, expr := range []ast.Expr{n.Key, n.Value} {
+					if v, ok := x.localVar(expr); ok {
+						x.assignments[v]++
+					}
+				}
+			case *ast.UnaryExpr:
+				// The variable may be assigned through the pointer.
+				if v, ok := x.localVar(n.X); ok && n.Op == token.AND {
+					x.assignments[v]++
+				}
+			}
+			return true
+		})
+	}
+	return x
+}
+
+func (x *extractor) collectValueSpec(spec *ast.ValueSpec) {
+	for i, name := range spec.Names {
+		switch obj := x.info.Defs[name].(type) {
+		case *types.Const:
+			// Implicitly repeated constants have no value expression.
+			if i < len(spec.Values) {
+				x.consts[obj] = &spec.Values[i]
+			}
+		case *types.Var:
+			if !isLocalVar(obj) {
+				continue
+			}
+			switch {
+			case len(spec.Values) == 0:
+				// Variables without initial value hold the zero value
+				// of their type.
+				x.assignments[obj]++
+				x.zeros[obj] = true
+			case len(spec.Values) != len(spec.Names):
+				// Variables assigned the results of a call have no value
+				// expression of their own.
+				x.assignments[obj]++
+			default:
+				x.vars[obj] = &spec.Values[i]
+				x.values[obj] = append(x.values[obj], spec.Values[i])
+				x.assignments[obj]++
+			}
+		}
+	}
+}
+
+func (x *extractor) collectAssignStmt(assignStmt *ast.AssignStmt) {
+	for i, lhs := range assignStmt.Lhs {
+		v, ok := x.localVar(lhs)
+		if !ok {
+			continue
+		}
+		x.assignments[v]++
+		isAssign := assignStmt.Tok == token.DEFINE || assignStmt.Tok == token.ASSIGN
+		if isAssign && len(assignStmt.Lhs) == len(assignStmt.Rhs) {
+			x.vars[v] = &assignStmt.Rhs[i]
+			x.values[v] = append(x.values[v], assignStmt.Rhs[i])
+		}
+	}
+}
+
+func (x *extractor) collectFields(fields *ast.FieldList) {
+	if fields == nil {
+		return
+	}
+	for _, field := range fields.List {
+		for _, name := range field.Names {
+			if v, ok := x.localVar(name); ok {
+				x.assignments[v]++
+			}
+		}
+	}
+}
+
+// localVar returns the local variable that expr refers to.
+func (x *extractor) localVar(expr ast.Expr) (*types.Var, bool) {
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return nil, false
+	}
+	obj := x.info.Defs[ident]
+	if obj == nil {
+		obj = x.info.Uses[ident]
+	}
+	v, ok := obj.(*types.Var)
+	if !ok || !isLocalVar(v) {
+		return nil, false
+	}
+	return v, true
+}
+
+func isLocalVar(v *types.Var) bool {
+	if v.IsField() || v.Pkg() == nil {
+		return false
+	}
+	return v.Parent() != nil && v.Parent() != v.Pkg().Scope()
+}
+
+// maxArgValues is the maximum number of values a variable can take to be
+// used as a set of constant Sprintf arguments.
+const maxArgValues = 8
+
+// argValues returns the constant values expr can take. A local variable
+// only assigned constants can take each of them, and the zero value of its
+// type if it is declared without value.
+func (x *extractor) argValues(expr ast.Expr) []constant.Value {
+	if tv, ok := x.info.Types[expr]; ok && tv.Value != nil {
+		return []constant.Value{tv.Value}
+	}
+
+	ident, ok := expr.(*ast.Ident)
+	if !ok {
+		return nil
+	}
+	v, ok := x.info.Uses[ident].(*types.Var)
+	if !ok || !isLocalVar(v) {
+		return nil
+	}
+	exprs := x.values[v]
+	all := make([]constant.Value, 0, len(exprs)+1)
+	if x.zeros[v] {
+		zero, ok := zeroValue(v.Type())
+		if !ok {
+			return nil
+		}
+		all = append(all, zero)
+	}
+	if len(all)+len(exprs) != x.assignments[v] || len(all)+len(exprs) > maxArgValues {
+		return nil
+	}
+	for _, expr := range exprs {
+		tv, ok := x.info.Types[expr]
+		if !ok || tv.Value == nil {
+			return nil
+		}
+		all = append(all, tv.Value)
+	}
+
+	values := make([]constant.Value, 0, len(all))
+	seen := make(map[string]bool)
+	for _, value := range all {
+		if key := value.ExactString(); !seen[key] {
+			seen[key] = true
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// zeroValue returns the zero value of typ as a constant if typ is a basic
+// type.
+func zeroValue(typ types.Type) (constant.Value, bool) {
+	basic, ok := typ.Underlying().(*types.Basic)
+	if !ok {
+		return nil, false
+	}
+	switch info := basic.Info(); {
+	case info&types.IsBoolean != 0:
+		return constant.MakeBool(false), true
+	case info&types.IsString != 0:
+		return constant.MakeString(""), true
+	case info&types.IsInteger != 0:
+		return constant.MakeInt64(0), true
+	case info&types.IsFloat != 0:
+		return constant.MakeFloat64(0), true
+	}
+	return nil, false
+}
+
+// resolve returns the SQL expression of the value assigned to obj.
+func (x *extractor) resolve(obj types.Object, slot *ast.Expr) (*sqlExpr, bool) {
+	if x.resolving[obj] {
+		return nil, false
+	}
+	x.resolving[obj] = true
+	defer delete(x.resolving, obj)
+	return x.getSQLExpr(slot)
+}
+
+func (x *extractor) getSQLExpr(slot *ast.Expr) (*sqlExpr, bool) {
+	switch expr := (*slot).(type) {
+	case *ast.CallExpr:
+		// Check call function is fmt.Sprintf
+		if !isPackageFunc(x.info, expr.Fun, "fmt", "Sprintf") {
+			return nil, false
+		}
+
+		// Expect first argument is string literal
+		if len(expr.Args) < 1 {
+			return nil, false
+		}
+		value, ok := x.getSQLExpr(&expr.Args[0])
+		if !ok {
+			return nil, false
+		}
+		value.isFormat = true
+		value.args = make([][]constant.Value, 0, len(expr.Args)-1)
+		value.argTypes = make([]types.Type, 0, len(expr.Args)-1)
+		for _, arg := range expr.Args[1:] {
+			value.args = append(value.args, x.argValues(arg))
+			value.argTypes = append(value.argTypes, x.info.TypeOf(arg))
+		}
+		return value, true
+	case *ast.Ident:
+		switch obj := x.info.Uses[expr].(type) {
+		case *types.Const:
+			// Constant declared in the package
+			if valueSlot, ok := x.consts[obj]; ok {
+				return x.resolve(obj, valueSlot)
+			}
+		case *types.Var:
+			// Local variable assigned only once
+			if valueSlot, ok := x.vars[obj]; ok && x.assignments[obj] == 1 {
+				return x.resolve(obj, valueSlot)
+			}
+		}
+	default:
+		// Direct string literal or concatenation of string literals
+		if query, ok := concatStringLits(expr); ok {
+			return &sqlExpr{
+				slot:  slot,
+				query: query,
+				pos:   expr.Pos(),
+			}, true
+		}
+	}
+
+	// Other constant expressions can be linted but not rewritten.
+	tv, ok := x.info.Types[*slot]
+	if !ok || tv.Value == nil || tv.Value.Kind() != constant.String {
+		return nil, false
+	}
+	return &sqlExpr{
+		slot:  nil,
+		query: constant.StringVal(tv.Value),
+		pos:   (*slot).Pos(),
+	}, true
+}
+
+func (x *extractor) findSpannerSQLExpr(node *ast.File) []*sqlExpr {
+	sqlExprs := make([]*sqlExpr, 0)
+	ast.Inspect(node, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.CompositeLit:
+			sqlExprs = append(sqlExprs, x.findStatementLitSQLExpr(n)...)
+		case *ast.CallExpr:
+			sqlExprs = append(sqlExprs, x.findNewStatementSQLExpr(n)...)
+		case *ast.AssignStmt:
+			sqlExprs = append(sqlExprs, x.findFieldAssignSQLExpr(n)...)
+		}
+		return true
+	})
+
+	return sqlExprs
+}
+
+// findStatementLitSQLExpr finds the SQL field of a spanner.Statement{...}
+// composite literal.
+func (x *extractor) findStatementLitSQLExpr(compositeLitExpr *ast.CompositeLit) []*sqlExpr {
+	// Resolve the literal type so that aliased and dot imports are
+	// handled and look-alike types are ignored.
+	if !isSpannerStatement(x.info.TypeOf(compositeLitExpr)) {
+		return nil
+	}
+
+	// Unkeyed literal like spanner.Statement{"SELECT 1", nil}
+	if len(compositeLitExpr.Elts) > 0 {
+		if _, ok := compositeLitExpr.Elts[0].(*ast.KeyValueExpr); !ok {
+			i, ok := sqlFieldIndex(x.info.TypeOf(compositeLitExpr))
+			if !ok || i >= len(compositeLitExpr.Elts) {
+				return nil
+			}
+			value, ok := x.getSQLExpr(&compositeLitExpr.Elts[i])
+			if !ok {
+				return nil
+			}
+			return []*sqlExpr{value}
+		}
+	}
+
+	sqlExprs := make([]*sqlExpr, 0)
+	for _, elt := range compositeLitExpr.Elts {
+		elt, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		key, ok := elt.Key.(*ast.Ident)
+		if !ok {
+			continue
+		}
+		if key.Name != "SQL" {
+			continue
+		}
+		value, ok := x.getSQLExpr(&elt.Value)
+		if !ok {
+			continue
+		}
+
+		sqlExprs = append(sqlExprs, value)
+	}
+	return sqlExprs
+}
+
+// findNewStatementSQLExpr finds the first argument of a
+// spanner.NewStatement(...) call.
+func (x *extractor) findNewStatementSQLExpr(callExpr *ast.CallExpr) []*sqlExpr {
+	if !isPackageFunc(x.info, callExpr.Fun, spannerPkgPath, "NewStatement") {
+		return nil
+	}
+	if len(callExpr.Args) < 1 {
+		return nil
+	}
+	value, ok := x.getSQLExpr(&callExpr.Args[0])
+	if !ok {
+		return nil
+	}
+	return []*sqlExpr{value}
+}
+
+// findFieldAssignSQLExpr finds SQL assigned to the SQL field of a
+// spanner.Statement like stmt.SQL = "...".
+func (x *extractor) findFieldAssignSQLExpr(assignStmt *ast.AssignStmt) []*sqlExpr {
+	if assignStmt.Tok != token.ASSIGN || len(assignStmt.Lhs) != len(assignStmt.Rhs) {
+		return nil
+	}
+
+	sqlExprs := make([]*sqlExpr, 0)
+	for i, lhs := range assignStmt.Lhs {
+		selectorExpr, ok := lhs.(*ast.SelectorExpr)
+		if !ok || selectorExpr.Sel.Name != "SQL" {
+			continue
+		}
+		if !isSpannerStatement(x.info.TypeOf(selectorExpr.X)) {
+			continue
+		}
+		value, ok := x.getSQLExpr(&assignStmt.Rhs[i])
+		if !ok {
+			continue
+		}
+
+		sqlExprs = append(sqlExprs, value)
+	}
+	return sqlExprs
+}
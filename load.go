@@ -0,0 +1,85 @@
+package spqex
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sourceFile is a parsed Go file.
+type sourceFile struct {
+	path   string
+	source []byte
+	node   *ast.File
+}
+
+func parseFile(fset *token.FileSet, path string) (*sourceFile, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %v", path, err)
+	}
+
+	node, err := parser.ParseFile(fset, path, source, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file %s: %v", path, err)
+	}
+
+	return &sourceFile{
+		path:   path,
+		source: source,
+		node:   node,
+	}, nil
+}
+
+// parseSiblingFiles parses the other files of the package of file in the
+// same directory. They are only needed to resolve identifiers, so files that
+// cannot be parsed are skipped.
+func parseSiblingFiles(fset *token.FileSet, file *sourceFile) []*sourceFile {
+	dir := filepath.Dir(file.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	siblings := make([]*sourceFile, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".go" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if filepath.Clean(path) == filepath.Clean(file.path) {
+			continue
+		}
+		sibling, err := parseFile(fset, path)
+		if err != nil {
+			continue
+		}
+		if sibling.node.Name.Name != file.node.Name.Name {
+			continue
+		}
+		siblings = append(siblings, sibling)
+	}
+	return siblings
+}
+
+// groupPackages groups files by directory and package name, keeping the
+// order in which the packages first appear.
+func groupPackages(files []*sourceFile) [][]*sourceFile {
+	packages := make([][]*sourceFile, 0)
+	indexes := make(map[string]int)
+	for _, file := range files {
+		key := strings.Join([]string{filepath.Dir(file.path), file.node.Name.Name}, "\x00")
+		i, ok := indexes[key]
+		if !ok {
+			i = len(packages)
+			indexes[key] = i
+			packages = append(packages, nil)
+		}
+		packages[i] = append(packages[i], file)
+	}
+	return packages
+}
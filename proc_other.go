@@ -0,0 +1,16 @@
+//go:build !unix
+
+package spqex
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup does nothing on systems without process groups, where
+// only cmd itself can be killed.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills a started cmd.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,299 @@
+package spqex
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// serverShutdownTimeout is how long a server process is given to exit after
+// the shutdown request before it is killed.
+const serverShutdownTimeout = 5 * time.Second
+
+// Server keeps long-running processes of a command alive and sends them
+// queries with a JSON-RPC style protocol over their standard input and
+// output, one JSON object per line.
+//
+// A request to format a query is
+//
+//	{"id":1,"method":"format","params":{"sql":"SELECT 1","mode":"fmt","position":"main.go:9:11"}}
+//
+// and the process responds with the formatted SQL, or with a diagnostic if
+// the query has an error:
+//
+//	{"id":1,"result":{"sql":"SELECT\n  1"}}
+//	{"id":1,"error":{"message":"syntax error"}}
+//
+// On Close, each process receives a request such as
+// {"id":3,"method":"shutdown"} and its standard input is closed. A process
+// that crashes is restarted. testdata/stubformatter is an example of such a
+// command.
+type Server struct {
+	// Stderr receives what the processes write to their standard error,
+	// which cannot be attributed to one query. It is discarded if nil, and
+	// must be set before the first query.
+	Stderr io.Writer
+
+	command string
+	// idle holds the processes that are not handling a request.
+	idle chan *serverProcess
+	// slots holds a token for each running process, so that at most
+	// cap(slots) processes are started.
+	slots chan struct{}
+	// stderrMu serializes the writes of the processes to Stderr.
+	stderrMu sync.Mutex
+}
+
+// stderrWriter writes the standard error of a process to the Stderr of its
+// server.
+type stderrWriter struct {
+	server *Server
+}
+
+func (w *stderrWriter) Write(p []byte) (int, error) {
+	w.server.stderrMu.Lock()
+	defer w.server.stderrMu.Unlock()
+	return w.server.Stderr.Write(p)
+}
+
+// NewServer returns a Server running at most n processes of command. The
+// processes are started when they are first needed.
+func NewServer(command string, n int) *Server {
+	n = max(n, 1)
+	return &Server{
+		command: command,
+		idle:    make(chan *serverProcess, n),
+		slots:   make(chan struct{}, n),
+	}
+}
+
+// serverRequest is a request sent to a server process.
+type serverRequest struct {
+	ID     int           `json:"id"`
+	Method string        `json:"method"`
+	Params *serverParams `json:"params,omitempty"`
+}
+
+// serverParams are the parameters of a format request.
+type serverParams struct {
+	SQL string `json:"sql"`
+	// Mode is "fmt" or "lint".
+	Mode string `json:"mode"`
+	// Position is the position of the SQL in the Go code.
+	Position string `json:"position"`
+}
+
+// serverResponse is a response of a server process.
+type serverResponse struct {
+	ID     int `json:"id"`
+	Result *struct {
+		SQL string `json:"sql"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// serverProcess is a running process of the command of a Server.
+type serverProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	nextID int
+}
+
+func startServerProcess(command string, stderr io.Writer) (*serverProcess, error) {
+	cmd := exec.Command("bash", "-c", command)
+	setProcessGroup(cmd)
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start command %q: %v", command, err)
+	}
+	return &serverProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+		nextID: 1,
+	}, nil
+}
+
+// request sends a request to the process and reads its response.
+func (p *serverProcess) request(method string, params *serverParams) (*serverResponse, error) {
+	req := &serverRequest{
+		ID:     p.nextID,
+		Method: method,
+		Params: params,
+	}
+	p.nextID++
+
+	line, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.stdin.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+
+	line, err = p.stdout.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	var res serverResponse
+	if err := json.Unmarshal(line, &res); err != nil {
+		return nil, fmt.Errorf("failed to decode response %q: %v", line, err)
+	}
+	if res.ID != req.ID {
+		return nil, fmt.Errorf("response id %d does not match request id %d", res.ID, req.ID)
+	}
+	return &res, nil
+}
+
+// requestContext is request that gives up and kills the process when ctx
+// is done.
+func (p *serverProcess) requestContext(ctx context.Context, method string, params *serverParams) (*serverResponse, error) {
+	type reply struct {
+		res *serverResponse
+		err error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		res, err := p.request(method, params)
+		replies <- reply{res, err}
+	}()
+
+	select {
+	case r := <-replies:
+		return r.res, r.err
+	case <-ctx.Done():
+		p.kill()
+		<-replies
+		return nil, ctx.Err()
+	}
+}
+
+// shutdown asks the process to exit and kills it if it does not exit in
+// time.
+func (p *serverProcess) shutdown() {
+	done := make(chan struct{})
+	go func() {
+		_, _ = p.request("shutdown", nil)
+		p.stdin.Close()
+		_ = p.cmd.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(serverShutdownTimeout):
+		_ = killProcessGroup(p.cmd)
+		<-done
+	}
+}
+
+// kill stops a process that crashed or does not follow the protocol.
+func (p *serverProcess) kill() {
+	p.stdin.Close()
+	_ = killProcessGroup(p.cmd)
+	_ = p.cmd.Wait()
+}
+
+// acquire returns an idle process, or starts one if fewer processes than
+// allowed are running.
+func (s *Server) acquire() (*serverProcess, error) {
+	select {
+	case p := <-s.idle:
+		return p, nil
+	case s.slots <- struct{}{}:
+		var stderr io.Writer
+		if s.Stderr != nil {
+			stderr = &stderrWriter{server: s}
+		}
+		p, err := startServerProcess(s.command, stderr)
+		if err != nil {
+			<-s.slots
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+// Format sends sql to a process of the server. The process is restarted,
+// and the request sent again once, if it crashes. If the deadline of ctx
+// passes, the process is killed and the result is marked as timed out.
+func (s *Server) Format(ctx context.Context, sql, mode, position string) (*CommandResult, error) {
+	params := &serverParams{
+		SQL:      sql,
+		Mode:     mode,
+		Position: position,
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var p *serverProcess
+		p, err = s.acquire()
+		if err != nil {
+			return nil, err
+		}
+
+		var res *serverResponse
+		res, err = p.requestContext(ctx, "format", params)
+		// The process is killed when ctx is done.
+		if errors.Is(err, context.DeadlineExceeded) {
+			<-s.slots
+			return &CommandResult{
+				ExitCode: -1,
+				TimedOut: true,
+			}, nil
+		}
+		if errors.Is(err, context.Canceled) {
+			<-s.slots
+			return nil, err
+		}
+		if err != nil {
+			p.kill()
+			<-s.slots
+			continue
+		}
+		s.idle <- p
+
+		switch {
+		case res.Error != nil:
+			return &CommandResult{
+				Stderr:   res.Error.Message,
+				ExitCode: 1,
+			}, nil
+		case res.Result != nil:
+			return &CommandResult{
+				Output:   string(trimNewlines([]byte(res.Result.SQL))),
+				ExitCode: 0,
+			}, nil
+		default:
+			return nil, fmt.Errorf("command %q responded with neither result nor error", s.command)
+		}
+	}
+	return nil, fmt.Errorf("command %q crashed: %v", s.command, err)
+}
+
+// Close shuts down the processes of the server. It must not be called while
+// queries are being formatted.
+func (s *Server) Close() {
+	for len(s.slots) > 0 {
+		p := <-s.idle
+		p.shutdown()
+		<-s.slots
+	}
+}
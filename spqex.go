@@ -2,110 +2,78 @@ package spqex
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"go/ast"
 	"go/format"
-	"go/parser"
-	"go/printer"
 	"go/token"
+	"go/types"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-func getBasicLitExpr(expr ast.Expr) (*ast.BasicLit, bool) {
-	switch expr := expr.(type) {
-	case *ast.BasicLit:
-		// Direct string literal
-		return expr, true
-	case *ast.CallExpr:
-		// fmt.Sprintf
-		fn, ok := expr.Fun.(*ast.SelectorExpr)
-		if !ok {
-			return nil, false
-		}
-		pkgIdent, ok := fn.X.(*ast.Ident)
-		if !ok {
-			return nil, false
-		}
-		// Check call function is fmt.Sprintf
-		if pkgIdent.Name != "fmt" || fn.Sel.Name != "Sprintf" {
-			return nil, false
+// quoteSQL returns a Go string expression of sql in style. A raw string
+// literal is used for multi-line SQL and SQL with quotes or backslashes,
+// which would otherwise need escaping. Backquotes in multi-line SQL are
+// written as "`" joined to raw string literals so that the newlines are
+// kept. indent is the indentation of the line of the literal and original
+// is the source text of the replaced expression.
+func quoteSQL(sql string, style LiteralStyle, indent, original string) (string, error) {
+	raw := style.RawSingleLine
+	if style.KeepKind {
+		switch {
+		case strings.HasPrefix(original, "`"):
+			raw = true
+		case strings.HasPrefix(original, `"`):
+			return strconv.Quote(sql), nil
 		}
-
-		// Expect first argument is string literal
-		if len(expr.Args) < 1 {
-			return nil, false
-		}
-		argExpr := expr.Args[0]
-		basicLitExpr, ok := argExpr.(*ast.BasicLit)
-		if !ok {
-			return nil, false
-		}
-		return basicLitExpr, true
 	}
-	return nil, false
-}
 
-func findSpannerSQLExpr(node *ast.File) []*ast.BasicLit {
-	basicLitExprs := make([]*ast.BasicLit, 0)
-	ast.Inspect(node, func(n ast.Node) bool {
-		compositeLitExpr, ok := n.(*ast.CompositeLit)
-		if !ok {
-			return true
+	if hasNewline(sql) {
+		open, close := "`\n", "\n`"
+		if style.NoLeadingNewline {
+			open = "`"
+			sql = strings.TrimLeft(sql, " \t")
 		}
-
-		selectorExpr, ok := compositeLitExpr.Type.(*ast.SelectorExpr)
-		if !ok {
-			return true
+		if style.IndentClosing {
+			close = "\n" + indent + "`"
 		}
-
-		pkgIdent, ok := selectorExpr.X.(*ast.Ident)
-		if !ok {
-			return true
+		if canRawQuote(sql) {
+			return open + sql + close, nil
 		}
-
-		if pkgIdent.Name != "spanner" && selectorExpr.Sel.Name != "Statement" {
-			return true
+		if canRawQuote(strings.ReplaceAll(sql, "`", "")) {
+			segments := strings.ReplaceAll(sql, "`", "` + \"`\" + `")
+			return open + segments + close, nil
 		}
-
-		for _, elt := range compositeLitExpr.Elts {
-			elt, ok := elt.(*ast.KeyValueExpr)
-			if !ok {
-				continue
-			}
-			key, ok := elt.Key.(*ast.Ident)
-			if !ok {
-				continue
-			}
-			if key.Name != "SQL" {
-				continue
-			}
-			value, ok := getBasicLitExpr(elt.Value)
-			if !ok {
-				continue
-			}
-
-			basicLitExprs = append(basicLitExprs, value)
+		// A raw string literal cannot hold the SQL, so it is collapsed into
+		// a single line.
+		collapsed, err := removeNewlines(sql)
+		if err != nil {
+			return "", err
 		}
-
-		return true
-	})
-
-	return basicLitExprs
-}
-
-func trimQuotes(s string) string {
-	if len(s) < 2 {
-		return s
+		return strconv.Quote(collapsed), nil
 	}
-	if (s[0] != '"' && s[0] != '`') || (s[len(s)-1] != '"' && s[len(s)-1] != '`') {
-		return s
+	if canRawQuote(sql) && (raw || strings.ContainsAny(sql, `"\`)) {
+		return fmt.Sprintf("`%s`", sql), nil
 	}
-	return s[1 : len(s)-1]
+	return strconv.Quote(sql), nil
+}
+
+// canRawQuote reports whether s can be written as a raw string literal
+// without changing its value. Go source cannot hold NUL or invalid UTF-8,
+// and carriage returns are removed from raw string literals.
+func canRawQuote(s string) bool {
+	return utf8.ValidString(s) && !strings.ContainsAny(s, "`\r\x00") && !strings.ContainsRune(s, '\uFEFF')
 }
 
 func trimNewlines(data []byte) []byte {
@@ -120,18 +88,135 @@ func trimNewlines(data []byte) []byte {
 	return data
 }
 
-func removeNewlines(input string) string {
+var whitespacesPattern = regexp.MustCompile(`\s{2,}`)
+
+// removeNewlines collapses sql into a single line. It returns an error if
+// the collapse would change what the query means: a line comment that would
+// comment out the rest of the query, or newlines and consecutive whitespaces
+// in quoted strings and identifiers.
+func removeNewlines(input string) (string, error) {
+	if err := checkCollapsible(input); err != nil {
+		return "", err
+	}
+
 	// remove multiple spaces
-	re := regexp.MustCompile(`\s{2,}`)
-	result := re.ReplaceAllString(input, " ")
+	result := whitespacesPattern.ReplaceAllString(input, " ")
 	// remove newlines
 	result = strings.ReplaceAll(result, "\n", " ")
 	result = strings.TrimSpace(result)
-	return result
+	return result, nil
+}
+
+func checkCollapsible(sql string) error {
+	for i := 0; i < len(sql); i++ {
+		switch {
+		case strings.HasPrefix(sql[i:], "--") || sql[i] == '#':
+			end := strings.IndexByte(sql[i:], '\n')
+			if end >= 0 && strings.TrimSpace(sql[i+end:]) != "" {
+				return fmt.Errorf("cannot collapse SQL into a single line: line comment %q would comment out the rest of the query", sql[i:i+end])
+			}
+			return nil
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				return nil
+			}
+			i += end + 3
+		case sql[i] == '\'' || sql[i] == '"' || sql[i] == '`':
+			quote := sql[i : i+1]
+			if strings.HasPrefix(sql[i:], strings.Repeat(quote, 3)) {
+				quote = strings.Repeat(quote, 3)
+			}
+			j := i + len(quote)
+			for j < len(sql) && !strings.HasPrefix(sql[j:], quote) {
+				if sql[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			quoted := sql[i:min(j+len(quote), len(sql))]
+			if strings.Contains(quoted, "\n") || whitespacesPattern.MatchString(quoted) {
+				return fmt.Errorf("cannot collapse SQL into a single line: whitespaces in %q would change", quoted)
+			}
+			i = j + len(quote) - 1
+		}
+	}
+	return nil
 }
 
-func hasBackquotes(input string) bool {
-	return strings.Contains(input, "`")
+// exprText returns the source text of expr.
+func exprText(fset *token.FileSet, sources map[string][]byte, expr ast.Expr) string {
+	start := fset.Position(expr.Pos())
+	end := fset.Position(expr.End())
+	return string(sources[start.Filename][start.Offset:end.Offset])
+}
+
+// lineIndent returns the indentation of the line at offset in source.
+func lineIndent(source []byte, offset int) string {
+	start := bytes.LastIndexByte(source[:offset], '\n') + 1
+	end := start
+	for end < len(source) && (source[end] == ' ' || source[end] == '\t') {
+		end++
+	}
+	return string(source[start:end])
+}
+
+// indentSQL prefixes the non-blank lines of multi-line sql with indent.
+func indentSQL(sql string, indent string) string {
+	if !hasNewline(sql) {
+		return sql
+	}
+	lines := strings.Split(sql, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			lines[i] = indent + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// dedentSQL removes the indentation common to the non-blank lines of sql
+// and the whitespaces of blank lines. The first line follows the opening
+// quote, so its indentation is removed regardless of the others.
+func dedentSQL(sql string) string {
+	lines := strings.Split(sql, "\n")
+	lines[0] = strings.TrimLeft(lines[0], " \t")
+	indent := ""
+	found := false
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lineIndent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found {
+			indent = lineIndent
+			found = true
+			continue
+		}
+		for !strings.HasPrefix(lineIndent, indent) {
+			indent = indent[:len(indent)-1]
+		}
+	}
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines[i] = ""
+			continue
+		}
+		lines[i] = strings.TrimPrefix(line, indent)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// trimClosingLine removes the last line of sql if it only holds the
+// indentation of the closing quote, as written with
+// LiteralStyle.IndentClosing, so that it is not passed to the command and
+// added again to the rewritten literal.
+func trimClosingLine(sql string) string {
+	i := strings.LastIndexByte(sql, '\n')
+	if i < 0 || strings.TrimSpace(sql[i+1:]) != "" {
+		return sql
+	}
+	return sql[:i]
 }
 
 func hasNewline(s string) bool {
@@ -139,39 +224,165 @@ func hasNewline(s string) bool {
 }
 
 type CommandResult struct {
-	Output   string
+	// Output is the standard output of the command.
+	Output string
+	// Stderr is the standard error of the command.
+	Stderr   string
 	ExitCode int
+	// TimedOut reports whether the command was killed because the deadline
+	// of its context passed.
+	TimedOut bool
 }
 
-func RunCommand(command, sql string) (*CommandResult, error) {
-	cmd := exec.Command("bash", "-c", command)
+// commandWaitDelay is how long a killed command is waited for before its
+// outputs are closed.
+const commandWaitDelay = time.Second
+
+// newCommand returns a command running command with bash. The command and
+// the processes it starts are killed when ctx is done.
+func newCommand(ctx context.Context, command string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "bash", "-c", command)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
+
+// RunCommand runs command with sql as its standard input. If the deadline
+// of ctx passes, the command is killed and the result is marked as timed
+// out. If ctx is canceled, an error is returned.
+func RunCommand(ctx context.Context, command, sql string) (*CommandResult, error) {
+	cmd := newCommand(ctx, command)
 	cmd.Stdin = strings.NewReader(sql)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 
-	output, err := cmd.CombinedOutput()
+	err := cmd.Run()
 
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &CommandResult{
+			Output:   string(trimNewlines(stdout.Bytes())),
+			Stderr:   string(trimNewlines(stderr.Bytes())),
+			ExitCode: -1,
+			TimedOut: true,
+		}, nil
+	}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("failed to execute command %q: %v", command, ctx.Err())
+	}
 	var exitError *exec.ExitError
 	if err != nil && !errors.As(err, &exitError) {
 		return nil, fmt.Errorf("failed to execute command %q: %v", command, err)
 	}
 
-	output = trimNewlines(output)
-
+	result := &CommandResult{
+		Output:   string(trimNewlines(stdout.Bytes())),
+		Stderr:   string(trimNewlines(stderr.Bytes())),
+		ExitCode: 0,
+	}
 	if exitError != nil {
-		return &CommandResult{
-			Output:   string(output),
-			ExitCode: exitError.ExitCode(),
-		}, nil
+		result.ExitCode = exitError.ExitCode()
 	}
-	return &CommandResult{
-		Output:   string(output),
-		ExitCode: 0,
-	}, nil
+	return result, nil
+}
+
+// withTimeout returns ctx with the timeout of opts for one run of the
+// command, if any.
+func withTimeout(ctx context.Context, opts *Options) (context.Context, context.CancelFunc) {
+	if opts.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, opts.Timeout)
+}
+
+// commandJob is a run of the command for a query.
+type commandJob struct {
+	query string
+	// position is the position of the SQL in the Go code.
+	position string
+	result   *CommandResult
+	err      error
+	// chunkStderr is what the command printed to the standard error for
+	// the chunk of queries starting with this one in batch mode.
+	chunkStderr string
+}
+
+// runCommands runs the command for the queries of jobs, at most
+// opts.Jobs at a time. In batch mode, the queries are passed to the command
+// in chunks instead of one by one, and with a server, they are sent to its
+// processes.
+func runCommands(ctx context.Context, jobs []*commandJob, opts *Options) {
+	n := opts.Jobs
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+
+	mode := "lint"
+	if opts.Replace {
+		mode = "fmt"
+	}
+
+	chunks := make([][]*commandJob, 0, len(jobs))
+	if opts.Batch != "" && opts.Server == nil {
+		chunks = chunkJobs(jobs, opts.BatchSize, n)
+	} else {
+		for _, job := range jobs {
+			chunks = append(chunks, []*commandJob{job})
+		}
+	}
+
+	queue := make(chan []*commandJob)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < min(n, len(chunks)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range queue {
+				if opts.Batch != "" && opts.Server == nil {
+					runBatch(ctx, opts, chunk)
+					continue
+				}
+				for _, job := range chunk {
+					// The queries left when ctx is canceled are not run.
+					if err := ctx.Err(); err != nil {
+						job.err = err
+						continue
+					}
+					jobCtx, cancel := withTimeout(ctx, opts)
+					if opts.Server != nil {
+						job.result, job.err = opts.Server.Format(jobCtx, job.query, mode, job.position)
+					} else {
+						job.result, job.err = RunCommand(jobCtx, opts.Command, job.query)
+					}
+					cancel()
+				}
+			}
+		}()
+	}
+	for _, chunk := range chunks {
+		queue <- chunk
+	}
+	close(queue)
+	wg.Wait()
 }
 
 type ErrorMessage struct {
-	Query   string
+	Query string
+	// Message is the standard error of the command followed by its
+	// standard output, or the reason why the SQL cannot be rewritten.
 	Message string
+	// PosText is the position of the SQL in the Go code. It is empty for a
+	// warning about a chunk of queries in batch mode.
 	PosText string
+	// Stdout and Stderr are the outputs of the command, if it was run.
+	Stdout string
+	Stderr string
+	// TimedOut reports whether the command was killed because it took
+	// longer than Options.Timeout.
+	TimedOut bool
 }
 
 func (e *ErrorMessage) String() string {
@@ -183,6 +394,16 @@ type ProcessResult struct {
 	Output        []byte
 	ErrorMessages []*ErrorMessage
 	IsChanged     bool
+	// Warnings holds what the command printed to the standard error while
+	// succeeding.
+	Warnings []*ErrorMessage
+	// Unformatted holds the positions of the SQL that differs from the
+	// output of the command in fmt mode.
+	Unformatted []string
+	// Err is the error that stopped the file from being processed, such as
+	// a parse error or a command that could not be executed. The file is not
+	// rewritten if it is set.
+	Err error
 }
 
 func (r *ProcessResult) String() string {
@@ -200,119 +421,470 @@ func (r *ProcessResult) ExitCode() int {
 	return 0
 }
 
-func fillFormatVerbs(sql string) string {
-	dummyValues := make([]any, 0)
-	isVerb := false
-	for _, char := range sql {
-		if char == '%' {
-			isVerb = true
-		} else if isVerb {
-			switch char {
-			case 'd':
-				dummyValues = append(dummyValues, -999)
-			case 'v':
-				dummyValues = append(dummyValues, "_DUMMY_VALUE_")
-			case 's':
-				dummyValues = append(dummyValues, "_DUMMY_STRING_")
+// Options configures how SQL is processed.
+type Options struct {
+	// Command is executed with the SQL as standard input.
+	Command string
+	// Replace replaces the SQL with the output of the command (fmt mode).
+	Replace bool
+	// ExpandArgs lints the SQL once for each value of fmt.Sprintf
+	// arguments that can take several constant values.
+	ExpandArgs bool
+	// Indent indents multi-line SQL relative to the line of the literal in
+	// fmt mode. The indentation is removed before the SQL is passed to the
+	// command.
+	Indent bool
+	// Style configures the string literals the SQL is rewritten with in
+	// fmt mode.
+	Style LiteralStyle
+	// Timeout is the maximum time a run of the command may take. There is
+	// no limit if it is zero.
+	Timeout time.Duration
+	// Jobs is the maximum number of commands run at a time. It defaults to
+	// runtime.GOMAXPROCS(0).
+	Jobs int
+	// Batch passes the queries to one run of the command in chunks framed
+	// with BatchNUL or BatchJSONLines instead of running the command for
+	// each query. A chunk is run query by query if the command fails.
+	Batch string
+	// BatchSize is the number of queries in a chunk in batch mode. By
+	// default, the queries are split evenly between the workers.
+	BatchSize int
+	// Server formats the queries with long-running processes instead of
+	// running Command for each query or chunk.
+	Server *Server
+	// DummyValues overrides the values that the verbs of fmt.Sprintf are
+	// replaced with in lint mode, keyed by kind such as DummyIdentifier.
+	DummyValues map[string]string
+}
+
+// LiteralStyle configures the shape of the string literals rewritten SQL
+// is written with. The zero value writes multi-line SQL as a raw string
+// starting and ending with a newline, and single-line SQL as an interpreted
+// string unless it contains quotes or backslashes.
+type LiteralStyle struct {
+	// RawSingleLine writes single-line SQL as a raw string too.
+	RawSingleLine bool
+	// NoLeadingNewline starts multi-line SQL right after the opening
+	// backquote.
+	NoLeadingNewline bool
+	// IndentClosing indents the closing backquote of multi-line SQL like
+	// the line of the literal.
+	IndentClosing bool
+	// KeepKind keeps the kind of the replaced literal, raw or interpreted,
+	// when it can hold the SQL.
+	KeepKind bool
+}
+
+// Process runs the command for the SQL of the statements in the Go file at
+// path. The other files of its package are loaded to resolve constants, but
+// only the file at path is rewritten. If ctx is canceled, the running
+// commands are killed and the error of ctx is returned.
+func Process(ctx context.Context, path string, opts *Options) (*ProcessResult, error) {
+	fset := token.NewFileSet()
+
+	file, err := parseFile(fset, path)
+	if err != nil {
+		return nil, err
+	}
+	files := append([]*sourceFile{file}, parseSiblingFiles(fset, file)...)
+
+	run := planPackage(fset, files, []*sourceFile{file}, opts)
+	runCommands(ctx, run.jobs(), opts)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	result := run.finish()[0]
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return result, nil
+}
+
+// ProcessFiles runs the command for the SQL of the statements in the Go
+// files at paths. Files are processed together with the other given files of
+// their package, so constants declared in one file and used in another are
+// rewritten once. The results are in the order of paths. A file that cannot
+// be processed has its result's Err set, and the other files are processed
+// regardless. If ctx is canceled, the running commands are killed and the
+// error of ctx is returned.
+func ProcessFiles(ctx context.Context, paths []string, opts *Options) ([]*ProcessResult, error) {
+	fset := token.NewFileSet()
+
+	resultsByFile := make(map[string]*ProcessResult, len(paths))
+	files := make([]*sourceFile, 0, len(paths))
+	for _, path := range paths {
+		file, err := parseFile(fset, path)
+		if err != nil {
+			resultsByFile[path] = &ProcessResult{
+				File:          path,
+				ErrorMessages: make([]*ErrorMessage, 0),
+				Err:           err,
 			}
-			isVerb = false
+			continue
+		}
+		files = append(files, file)
+	}
+
+	runs := make([]*packageRun, 0)
+	jobs := make([]*commandJob, 0)
+	for _, pkgFiles := range groupPackages(files) {
+		run := planPackage(fset, pkgFiles, pkgFiles, opts)
+		runs = append(runs, run)
+		jobs = append(jobs, run.jobs()...)
+	}
+	runCommands(ctx, jobs, opts)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, run := range runs {
+		for _, result := range run.finish() {
+			resultsByFile[result.File] = result
 		}
 	}
 
-	return fmt.Sprintf(sql, dummyValues...)
+	results := make([]*ProcessResult, 0, len(paths))
+	for _, path := range paths {
+		results = append(results, resultsByFile[path])
+	}
+	return results, nil
 }
 
-func restoreFormatVerbs(sql string) string {
-	sql = strings.ReplaceAll(sql, "-999", "%d")
-	sql = strings.ReplaceAll(sql, "_DUMMY_VALUE_", "%v")
-	sql = strings.ReplaceAll(sql, "_DUMMY_STRING_", "%s")
-	return sql
+// lintQueries returns the queries passed to the command in lint mode. The
+// verbs of fmt.Sprintf are replaced with the constant values of their
+// arguments where they are known, and with dummy values chosen from the
+// SQL around them and the types of their arguments otherwise. With
+// opts.Indent, the indentation added in fmt mode is removed first.
+func lintQueries(expr *sqlExpr, opts *Options) []string {
+	query := expr.query
+	if opts.Indent {
+		query = dedentSQL(query)
+	}
+	if !expr.isFormat {
+		return []string{query}
+	}
+
+	dummy := func(verb *formatVerb, before string) string {
+		var typ types.Type
+		if verb.arg >= 0 && verb.arg < len(expr.argTypes) {
+			typ = expr.argTypes[verb.arg]
+		}
+		return dummyValue(opts.DummyValues, verb.verb, before, typ)
+	}
+
+	combinations := argCombinations(expr.args, opts.ExpandArgs)
+	queries := make([]string, 0, len(combinations))
+	for _, args := range combinations {
+		queries = append(queries, fillFormatArgs(query, args, dummy))
+	}
+	return queries
 }
 
-func Process(path string, externalCmd string, replace bool) (*ProcessResult, error) {
-	source, err := os.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file %s: %v", path, err)
+// sqlTask is the SQL of a statement and the runs of the command for it.
+type sqlTask struct {
+	// target is the index of the target file containing the statement.
+	target int
+	expr   *sqlExpr
+	// verbs are the verbs of fmt.Sprintf replaced with placeholders in the
+	// query in fmt mode.
+	verbs []*formatVerb
+	jobs  []*commandJob
+}
+
+// packageRun is the processing of the statements of a package. It is split
+// into planning the commands and applying their outputs, so that the
+// commands of all packages are run by one pool of workers.
+type packageRun struct {
+	fset    *token.FileSet
+	opts    *Options
+	sources map[string][]byte
+	targets []*sourceFile
+	tasks   []*sqlTask
+}
+
+// planPackage plans the commands for the statements in targets, resolving
+// identifiers with all files of the package.
+func planPackage(fset *token.FileSet, files []*sourceFile, targets []*sourceFile, opts *Options) *packageRun {
+	nodes := make([]*ast.File, 0, len(files))
+	for _, file := range files {
+		nodes = append(nodes, file.node)
 	}
+	info := typeCheck(fset, nodes)
+	x := newExtractor(nodes, info)
 
-	fset := token.NewFileSet()
+	sources := make(map[string][]byte, len(files))
+	for _, file := range files {
+		sources[file.path] = file.source
+	}
 
-	node, err := parser.ParseFile(fset, path, source, parser.ParseComments)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse file %s: %v", path, err)
+	tasks := make([]*sqlTask, 0)
+	// A constant may be used by several statements, so it is processed once.
+	processed := make(map[token.Pos]bool)
+	for i, target := range targets {
+		for _, expr := range x.findSpannerSQLExpr(target.node) {
+			if processed[expr.pos] {
+				continue
+			}
+			processed[expr.pos] = true
+
+			task := &sqlTask{
+				target: i,
+				expr:   expr,
+			}
+			if !opts.Replace {
+				for _, query := range lintQueries(expr, opts) {
+					task.jobs = append(task.jobs, &commandJob{
+						query:    query,
+						position: fset.Position(expr.pos).String(),
+					})
+				}
+				tasks = append(tasks, task)
+				continue
+			}
+
+			query := trimClosingLine(expr.query)
+			if opts.Indent {
+				query = dedentSQL(query)
+			}
+			if expr.isFormat {
+				query, task.verbs = fillFormatVerbs(query, newNonce(query))
+			}
+			task.jobs = []*commandJob{{
+				query:    query,
+				position: fset.Position(expr.pos).String(),
+			}}
+			tasks = append(tasks, task)
+		}
 	}
 
-	basicLitExprs := findSpannerSQLExpr(node)
+	return &packageRun{
+		fset:    fset,
+		opts:    opts,
+		sources: sources,
+		targets: targets,
+		tasks:   tasks,
+	}
+}
 
-	errMessages := make([]*ErrorMessage, 0, len(basicLitExprs))
-	if len(basicLitExprs) == 0 {
-		return &ProcessResult{
-			File:          path,
+// jobs returns the runs of the command planned for the package.
+func (p *packageRun) jobs() []*commandJob {
+	jobs := make([]*commandJob, 0, len(p.tasks))
+	for _, task := range p.tasks {
+		jobs = append(jobs, task.jobs...)
+	}
+	return jobs
+}
+
+// finish applies the outputs of the command to the targets. Only literals
+// located in targets are rewritten. An error running the command stops the
+// processing of the file and is set to its result.
+func (p *packageRun) finish() []*ProcessResult {
+	fset, opts := p.fset, p.opts
+
+	results := make([]*ProcessResult, 0, len(p.targets))
+	resultsByFile := make(map[string]*ProcessResult, len(p.targets))
+	for _, target := range p.targets {
+		result := &ProcessResult{
+			File:          target.path,
 			Output:        nil,
-			ErrorMessages: errMessages,
+			ErrorMessages: make([]*ErrorMessage, 0),
 			IsChanged:     false,
-		}, nil
+		}
+		results = append(results, result)
+		resultsByFile[target.path] = result
 	}
 
-	for _, basicLitExpr := range basicLitExprs {
-		query := trimQuotes(basicLitExpr.Value)
-		query = fillFormatVerbs(query)
-		r, err := RunCommand(externalCmd, query)
-		if err != nil {
-			return nil, fmt.Errorf("failed to run command: %v", err)
+	// positions holds the positions of the error messages and of the
+	// unformatted SQL, so that they are reported in order.
+	positions := make(map[*ErrorMessage]token.Position)
+	unformatted := make(map[*ProcessResult][]token.Position)
+	newMessage := func(query, message string, r *CommandResult, pos token.Pos) *ErrorMessage {
+		msg := &ErrorMessage{
+			Query:   query,
+			Message: message,
+			PosText: fset.Position(pos).String(),
+		}
+		if r != nil {
+			msg.Stdout = r.Output
+			msg.Stderr = r.Stderr
+			msg.TimedOut = r.TimedOut
 		}
+		positions[msg] = fset.Position(pos)
+		return msg
+	}
+	// report reports an error for the SQL at pos. r is the result of the
+	// command if the error comes from it.
+	report := func(result *ProcessResult, query, message string, r *CommandResult, pos token.Pos) {
+		result.ErrorMessages = append(result.ErrorMessages, newMessage(query, message, r, pos))
+	}
+	// warn reports what the command printed to the standard error while
+	// succeeding.
+	warn := func(result *ProcessResult, query string, r *CommandResult, pos token.Pos) {
+		if r.Stderr != "" {
+			result.Warnings = append(result.Warnings, newMessage(query, r.Stderr, r, pos))
+		}
+	}
+
+	for _, task := range p.tasks {
+		for _, job := range task.jobs {
+			if job.chunkStderr != "" {
+				result := results[task.target]
+				result.Warnings = append(result.Warnings, &ErrorMessage{
+					Message: job.chunkStderr,
+					Stderr:  job.chunkStderr,
+				})
+			}
+		}
+	}
+
+	edits := make(map[string][]textEdit, len(p.targets))
+tasks:
+	for _, task := range p.tasks {
+		expr := task.expr
+		i := task.target
+		if results[i].Err != nil {
+			continue
+		}
+		// The SQL of a constant may be declared in another target than the
+		// statement using it, and is reported with the file declaring it.
+		owner := results[i]
+		if result, ok := resultsByFile[fset.Position(expr.pos).Filename]; ok {
+			owner = result
+		}
+
+		if !opts.Replace {
+			for _, job := range task.jobs {
+				if job.err != nil {
+					results[i].Err = fmt.Errorf("failed to run command: %v", job.err)
+					continue tasks
+				}
+				if job.result.ExitCode != 0 {
+					report(owner, job.query, commandMessage(job.result, opts), job.result, expr.pos)
+					continue
+				}
+				warn(owner, job.query, job.result, expr.pos)
+			}
+			continue
+		}
+
+		job := task.jobs[0]
+		if job.err != nil {
+			results[i].Err = fmt.Errorf("failed to run command: %v", job.err)
+			continue
+		}
+		query, r := job.query, job.result
 		if r.ExitCode != 0 {
-			errMessages = append(errMessages, &ErrorMessage{
-				Query:   query,
-				Message: r.Output,
-				PosText: fset.Position(basicLitExpr.Pos()).String(),
-			})
+			report(owner, query, commandMessage(r, opts), r, expr.pos)
+			continue
+		}
+		warn(owner, query, r, expr.pos)
+		if expr.slot == nil {
 			continue
 		}
-		output := restoreFormatVerbs(r.Output)
-		if replace {
-			if hasBackquotes(output) {
-				output = removeNewlines(output)
-				basicLitExpr.Value = fmt.Sprintf("\"%s\"", output)
-			} else if hasNewline(output) {
-				basicLitExpr.Value = fmt.Sprintf("`\n%s\n`", output)
-			} else {
-				basicLitExpr.Value = fmt.Sprintf("\"%s\"", output)
+		result, ok := resultsByFile[fset.Position(expr.pos).Filename]
+		if !ok {
+			continue
+		}
+		output := r.Output
+		if expr.isFormat {
+			var err error
+			output, err = restoreFormatVerbs(output, task.verbs)
+			if err != nil {
+				report(owner, query, err.Error(), nil, expr.pos)
+				continue
 			}
 		}
+		pos := fset.Position(expr.pos)
+		indent := lineIndent(p.sources[pos.Filename], pos.Offset)
+		if opts.Indent {
+			output = indentSQL(output, indent+"\t")
+		}
+		original := exprText(fset, p.sources, *expr.slot)
+		value, err := quoteSQL(output, opts.Style, indent, original)
+		if err != nil {
+			report(owner, query, err.Error(), nil, expr.pos)
+			continue
+		}
+		// Formatted SQL is left as it is.
+		if value == original {
+			continue
+		}
+		edits[result.File] = append(edits[result.File], expr.edit(fset, value))
+		result.IsChanged = true
+		unformatted[result] = append(unformatted[result], pos)
 	}
 
-	if !replace || len(errMessages) == len(basicLitExprs) {
-		return &ProcessResult{
-			File:          path,
-			Output:        nil,
-			ErrorMessages: errMessages,
-			IsChanged:     false,
-		}, nil
+	for _, result := range results {
+		sort.SliceStable(result.ErrorMessages, func(i, j int) bool {
+			return positionLess(positions[result.ErrorMessages[i]], positions[result.ErrorMessages[j]])
+		})
+		sort.SliceStable(result.Warnings, func(i, j int) bool {
+			return positionLess(positions[result.Warnings[i]], positions[result.Warnings[j]])
+		})
+		sort.Slice(unformatted[result], func(i, j int) bool {
+			return positionLess(unformatted[result][i], unformatted[result][j])
+		})
+		for _, pos := range unformatted[result] {
+			result.Unformatted = append(result.Unformatted, pos.String())
+		}
 	}
 
-	var buf bytes.Buffer
-	if err := printer.Fprint(&buf, fset, node); err != nil {
-		return nil, fmt.Errorf("%s: failed to print AST: %v", path, err)
+	for i, target := range p.targets {
+		if results[i].Err != nil {
+			results[i].IsChanged = false
+			continue
+		}
+		if !results[i].IsChanged {
+			continue
+		}
+
+		output := applyEdits(target.source, edits[target.path])
+		// The edits change the width of the literals, so a file formatted
+		// with gofmt is formatted again to realign the code around them.
+		if formatted, err := format.Source(target.source); err == nil && bytes.Equal(formatted, target.source) {
+			if formatted, err := format.Source(output); err == nil {
+				output = formatted
+			}
+		}
+		results[i].Output = output
 	}
 
-	result, err := format.Source(buf.Bytes())
-	if err != nil {
-		return nil, fmt.Errorf("%s: failed to format source: %v", path, err)
+	return results
+}
+
+// commandMessage returns the message of a failed run of the command: its
+// standard error followed by its standard output.
+func commandMessage(r *CommandResult, opts *Options) string {
+	if r.TimedOut && opts.Timeout > 0 {
+		return fmt.Sprintf("command timed out after %s", opts.Timeout)
+	}
+	if r.TimedOut {
+		return "command timed out"
 	}
+	outputs := make([]string, 0, 2)
+	for _, output := range []string{r.Stderr, r.Output} {
+		if output != "" {
+			outputs = append(outputs, output)
+		}
+	}
+	return strings.Join(outputs, "\n")
+}
 
-	return &ProcessResult{
-		File:          path,
-		Output:        result,
-		ErrorMessages: errMessages,
-		IsChanged:     true,
-	}, nil
+// positionLess reports whether a is before b, ordering by file name first.
+func positionLess(a, b token.Position) bool {
+	if a.Filename != b.Filename {
+		return a.Filename < b.Filename
+	}
+	return a.Offset < b.Offset
 }
 
 func FindGoFiles(directory string) ([]string, error) {
 	files := make([]string, 0)
 
 	if err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if info.IsDir() {
 			if info.Name() == "testdata" {
 				return filepath.SkipDir
@@ -1,8 +1,17 @@
 package spqex
 
 import (
+	"bytes"
+	"context"
+	"go/constant"
+	"go/token"
+	"go/types"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -12,6 +21,12 @@ func TestProcess(t *testing.T) {
 		filePath   string
 		command    string
 		replace    bool
+		expandArgs bool
+		indent     bool
+		style      LiteralStyle
+		batch      string
+		batchSize  int
+		timeout    time.Duration
 		goldenFile string
 		want       *ProcessResult
 	}{
@@ -24,6 +39,9 @@ func TestProcess(t *testing.T) {
 				File:          "testdata/format.go",
 				ErrorMessages: []*ErrorMessage{},
 				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/format.go:9:11",
+				},
 			},
 		},
 		{
@@ -49,9 +67,13 @@ func TestProcess(t *testing.T) {
 						Query:   "SELECT * FROM HAS_ERROR;",
 						Message: "COMMAND ERROR",
 						PosText: "testdata/has_error.go:16:11",
+						Stderr:  "COMMAND ERROR",
 					},
 				},
 				IsChanged: true,
+				Unformatted: []string{
+					"testdata/has_error.go:9:11",
+				},
 			},
 		},
 		{
@@ -66,11 +88,95 @@ func TestProcess(t *testing.T) {
 						Query:   "SELECT * FROM HAS_ERROR;",
 						Message: "COMMAND ERROR",
 						PosText: "testdata/has_error.go:16:11",
+						Stderr:  "COMMAND ERROR",
 					},
 				},
 				IsChanged: false,
 			},
 		},
+		{
+			filePath:   "testdata/has_error.go",
+			command:    "./testdata/batch.sh",
+			replace:    true,
+			batch:      BatchNUL,
+			goldenFile: "testdata/has_error_golden.go",
+			want: &ProcessResult{
+				File: "testdata/has_error.go",
+				ErrorMessages: []*ErrorMessage{
+					{
+						Query:   "SELECT * FROM HAS_ERROR;",
+						Message: "COMMAND ERROR",
+						PosText: "testdata/has_error.go:16:11",
+						Stderr:  "COMMAND ERROR",
+					},
+				},
+				IsChanged: true,
+				Unformatted: []string{
+					"testdata/has_error.go:9:11",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/has_error.go",
+			command:    `sed -E -e 's/^\{"id":([0-9]+),.*HAS_ERROR.*$/{"id":\1,"error":"COMMAND ERROR"}/; s/TABLE/TABLE_A/g'`,
+			replace:    true,
+			batch:      BatchJSONLines,
+			goldenFile: "testdata/has_error_golden.go",
+			want: &ProcessResult{
+				File: "testdata/has_error.go",
+				ErrorMessages: []*ErrorMessage{
+					{
+						Query:   "SELECT * FROM HAS_ERROR;",
+						Message: "COMMAND ERROR",
+						PosText: "testdata/has_error.go:16:11",
+						Stderr:  "COMMAND ERROR",
+					},
+				},
+				IsChanged: true,
+				Unformatted: []string{
+					"testdata/has_error.go:9:11",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/alias.go",
+			command:    "sed -z -e 's/TABLE/TABLE_A/g'",
+			replace:    true,
+			batch:      BatchNUL,
+			goldenFile: "testdata/alias_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/alias.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/alias.go:9:11",
+					"testdata/alias.go:16:9",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/alias.go",
+			command:    "echo -n COMMAND WARNING 1>&2 && sed -z -e 's/TABLE/TABLE_A/g'",
+			replace:    true,
+			batch:      BatchNUL,
+			batchSize:  2,
+			goldenFile: "testdata/alias_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/alias.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Warnings: []*ErrorMessage{
+					{
+						Message: "COMMAND WARNING",
+						Stderr:  "COMMAND WARNING",
+					},
+				},
+				Unformatted: []string{
+					"testdata/alias.go:9:11",
+					"testdata/alias.go:16:9",
+				},
+			},
+		},
 		{
 			filePath:   "testdata/error_only.go",
 			command:    `echo -n "COMMAND ERROR" 1>&2 && exit 1`,
@@ -83,6 +189,7 @@ func TestProcess(t *testing.T) {
 						Query:   "SELECT * FROM TABLE;",
 						Message: "COMMAND ERROR",
 						PosText: "testdata/error_only.go:9:11",
+						Stderr:  "COMMAND ERROR",
 					},
 				},
 				IsChanged: false,
@@ -100,6 +207,68 @@ func TestProcess(t *testing.T) {
 						Query:   "SELECT * FROM TABLE;",
 						Message: "COMMAND ERROR",
 						PosText: "testdata/error_only.go:9:11",
+						Stderr:  "COMMAND ERROR",
+					},
+				},
+				IsChanged: false,
+			},
+		},
+		{
+			filePath:   "testdata/format.go",
+			command:    "echo -n WARNING 1>&2 && xargs echo -n | sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/format_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/format.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Warnings: []*ErrorMessage{
+					{
+						Query:   "SELECT * FROM TABLE;",
+						Message: "WARNING",
+						PosText: "testdata/format.go:9:11",
+						Stdout:  "SELECT * FROM TABLE_A;",
+						Stderr:  "WARNING",
+					},
+				},
+				Unformatted: []string{
+					"testdata/format.go:9:11",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/error_only.go",
+			command:    "echo -n OUTPUT && echo -n ERROR 1>&2 && exit 1",
+			replace:    true,
+			goldenFile: "testdata/error_only_golden.go",
+			want: &ProcessResult{
+				File: "testdata/error_only.go",
+				ErrorMessages: []*ErrorMessage{
+					{
+						Query:   "SELECT * FROM TABLE;",
+						Message: "ERROR\nOUTPUT",
+						PosText: "testdata/error_only.go:9:11",
+						Stdout:  "OUTPUT",
+						Stderr:  "ERROR",
+					},
+				},
+				IsChanged: false,
+			},
+		},
+		{
+			filePath:   "testdata/error_only.go",
+			command:    "sleep 10",
+			replace:    true,
+			timeout:    100 * time.Millisecond,
+			goldenFile: "testdata/error_only_golden.go",
+			want: &ProcessResult{
+				File: "testdata/error_only.go",
+				ErrorMessages: []*ErrorMessage{
+					{
+						Query:    "SELECT * FROM TABLE;",
+						Message:  "command timed out after 100ms",
+						PosText:  "testdata/error_only.go:9:11",
+						TimedOut: true,
 					},
 				},
 				IsChanged: false,
@@ -114,6 +283,11 @@ func TestProcess(t *testing.T) {
 				File:          "testdata/multiline.go",
 				ErrorMessages: []*ErrorMessage{},
 				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/multiline.go:9:11",
+					"testdata/multiline.go:16:8",
+					"testdata/multiline.go:25:8",
+				},
 			},
 		},
 		{
@@ -125,6 +299,9 @@ func TestProcess(t *testing.T) {
 				File:          "testdata/backquote.go",
 				ErrorMessages: []*ErrorMessage{},
 				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/backquote.go:9:11",
+				},
 			},
 		},
 		{
@@ -136,158 +313,932 @@ func TestProcess(t *testing.T) {
 				File:          "testdata/sprintf.go",
 				ErrorMessages: []*ErrorMessage{},
 				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/sprintf.go:11:23",
+				},
 			},
 		},
-	}
-
-	for _, test := range tests {
-		t.Run(test.filePath, func(t *testing.T) {
-			result, err := Process(test.filePath, test.command, test.replace)
-			if err != nil {
-				t.Fatalf("process(%q, %q) returned unexpected error: %v", test.filePath, test.command, err)
-			}
-
-			golden, err := os.ReadFile(test.goldenFile)
-			if err != nil {
-				t.Fatalf("failed to read golden file %s: %v", test.goldenFile, err)
-			}
-			if test.want.IsChanged {
-				test.want.Output = golden
-			}
-
-			if diff := cmp.Diff(test.want, result); diff != "" {
-				t.Errorf("process(%q, %q) returned unexpected result (-want +got):\n%s", test.filePath, test.command, diff)
-			}
-		})
-	}
-}
-
-func TestFindGoFiles(t *testing.T) {
-	files, err := FindGoFiles("testdata/filelist")
-	if err != nil {
-		t.Fatalf("findGoFiles(%q) returned unexpected error: %v", "testdata", err)
-	}
-
-	expected := []string{
-		"testdata/filelist/dir/file1.go",
-		"testdata/filelist/file1.go",
-		"testdata/filelist/file2.go",
-	}
-
-	if diff := cmp.Diff(expected, files); diff != "" {
-		t.Errorf("findGoFiles(%q) returned unexpected result (-want +got):\n%s", "testdata", diff)
-	}
-}
-
-func TestTrimQuotes(t *testing.T) {
-	tests := []struct {
-		arg  string
-		want string
-	}{
-		{
-			arg:  `"SELECT * FROM TABLE_A;"`,
-			want: `SELECT * FROM TABLE_A;`,
-		},
 		{
-			arg:  "`SELECT * FROM TABLE_A;`",
-			want: `SELECT * FROM TABLE_A;`,
+			filePath:   "testdata/sprintf_verbs.go",
+			command:    "sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/sprintf_verbs_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/sprintf_verbs.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/sprintf_verbs.go:11:23",
+				},
+			},
 		},
-	}
-
-	for _, test := range tests {
-		t.Run(test.arg, func(t *testing.T) {
-			got := trimQuotes(test.arg)
-			if got != test.want {
-				t.Errorf("trimQuotes(%q) = %q, want %q", test.arg, got, test.want)
-			}
-		})
-	}
-}
-
-func TestFillFormatVerbs(t *testing.T) {
-	tests := []struct {
-		arg  string
-		want string
-	}{
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY %s;",
-			want: "SELECT * FROM TABLE ORDER BY _DUMMY_STRING_;",
+			filePath:   "testdata/sprintf_args.go",
+			command:    "cat 1>&2 && exit 1",
+			replace:    false,
+			expandArgs: true,
+			goldenFile: "testdata/sprintf_args.go",
+			want: &ProcessResult{
+				File: "testdata/sprintf_args.go",
+				ErrorMessages: []*ErrorMessage{
+					{
+						Query:   "SELECT * FROM TABLE ORDER BY CreatedAt LIMIT 10;",
+						Message: "SELECT * FROM TABLE ORDER BY CreatedAt LIMIT 10;",
+						PosText: "testdata/sprintf_args.go:13:23",
+						Stderr:  "SELECT * FROM TABLE ORDER BY CreatedAt LIMIT 10;",
+					},
+					{
+						Query:   "SELECT * FROM TABLE ORDER BY CreatedAt;",
+						Message: "SELECT * FROM TABLE ORDER BY CreatedAt;",
+						PosText: "testdata/sprintf_args.go:24:23",
+						Stderr:  "SELECT * FROM TABLE ORDER BY CreatedAt;",
+					},
+					{
+						Query:   "SELECT * FROM TABLE ORDER BY Name;",
+						Message: "SELECT * FROM TABLE ORDER BY Name;",
+						PosText: "testdata/sprintf_args.go:24:23",
+						Stderr:  "SELECT * FROM TABLE ORDER BY Name;",
+					},
+					{
+						Query:   "SELECT * FROM TABLE ORDER BY Id;",
+						Message: "SELECT * FROM TABLE ORDER BY Id;",
+						PosText: "testdata/sprintf_args.go:35:23",
+						Stderr:  "SELECT * FROM TABLE ORDER BY Id;",
+					},
+					{
+						Query:   "SELECT * FROM TABLE ORDER BY Id DESC;",
+						Message: "SELECT * FROM TABLE ORDER BY Id DESC;",
+						PosText: "testdata/sprintf_args.go:35:23",
+						Stderr:  "SELECT * FROM TABLE ORDER BY Id DESC;",
+					},
+				},
+				IsChanged: false,
+			},
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY %v;",
-			want: "SELECT * FROM TABLE ORDER BY _DUMMY_VALUE_;",
+			filePath:   "testdata/sprintf_dummy.go",
+			command:    "cat 1>&2 && exit 1",
+			replace:    false,
+			goldenFile: "testdata/sprintf_dummy.go",
+			want: &ProcessResult{
+				File: "testdata/sprintf_dummy.go",
+				ErrorMessages: []*ErrorMessage{
+					{
+						Query:   "SELECT * FROM TABLE@{FORCE_INDEX=_BASE_TABLE} WHERE Id IN ('_DUMMY_1_', '_DUMMY_2_') AND Name IN ('_DUMMY_1_', '_DUMMY_2_') AND Kind = '_DUMMY_STRING_' ORDER BY _DUMMY_IDENTIFIER_ LIMIT 1;",
+						Message: "SELECT * FROM TABLE@{FORCE_INDEX=_BASE_TABLE} WHERE Id IN ('_DUMMY_1_', '_DUMMY_2_') AND Name IN ('_DUMMY_1_', '_DUMMY_2_') AND Kind = '_DUMMY_STRING_' ORDER BY _DUMMY_IDENTIFIER_ LIMIT 1;",
+						PosText: "testdata/sprintf_dummy.go:13:4",
+						Stderr:  "SELECT * FROM TABLE@{FORCE_INDEX=_BASE_TABLE} WHERE Id IN ('_DUMMY_1_', '_DUMMY_2_') AND Name IN ('_DUMMY_1_', '_DUMMY_2_') AND Kind = '_DUMMY_STRING_' ORDER BY _DUMMY_IDENTIFIER_ LIMIT 1;",
+					},
+				},
+				IsChanged: false,
+			},
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY %d;",
-			want: "SELECT * FROM TABLE ORDER BY -999;",
+			filePath:   "testdata/escape.go",
+			command:    "sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/escape_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/escape.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/escape.go:9:11",
+					"testdata/escape.go:16:11",
+				},
+			},
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY %v %v;",
-			want: "SELECT * FROM TABLE ORDER BY _DUMMY_VALUE_ _DUMMY_VALUE_;",
+			filePath:   "testdata/backquote_multiline.go",
+			command:    "sed -e 's/ FROM /\\nFROM\\n  /; s/ WHERE /\\nWHERE -- filter\\n  /; s/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/backquote_multiline_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/backquote_multiline.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/backquote_multiline.go:9:11",
+				},
+			},
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY %s %s;",
-			want: "SELECT * FROM TABLE ORDER BY _DUMMY_STRING_ _DUMMY_STRING_;",
+			filePath:   "testdata/indent.go",
+			command:    "xargs echo -n | sed -e 's/ FROM /\\nFROM\\n  /'",
+			replace:    true,
+			indent:     true,
+			goldenFile: "testdata/indent_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/indent.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/indent.go:9:11",
+					"testdata/indent.go:17:32",
+				},
+			},
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY %v %s;",
-			want: "SELECT * FROM TABLE ORDER BY _DUMMY_VALUE_ _DUMMY_STRING_;",
+			filePath:   "testdata/indent_golden.go",
+			command:    "xargs echo -n | sed -e 's/ FROM /\\nFROM\\n  /'",
+			replace:    true,
+			indent:     true,
+			goldenFile: "testdata/indent_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/indent_golden.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     false,
+			},
 		},
-	}
-	for _, test := range tests {
-		t.Run(test.arg, func(t *testing.T) {
-			got := fillFormatVerbs(test.arg)
-			if got != test.want {
-				t.Errorf("fillFormatVerbs(%q) = %q, want %q", test.arg, got, test.want)
-			}
-		})
-	}
-}
-
-func TestRestoreFormatVerbs(t *testing.T) {
-	tests := []struct {
-		arg  string
-		want string
-	}{
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY _DUMMY_STRING_;",
-			want: "SELECT * FROM TABLE ORDER BY %s;",
+			filePath:   "testdata/indent_golden.go",
+			command:    "cat 1>&2 && exit 1",
+			replace:    false,
+			indent:     true,
+			goldenFile: "testdata/indent_golden.go",
+			want: &ProcessResult{
+				File: "testdata/indent_golden.go",
+				ErrorMessages: []*ErrorMessage{
+					{
+						Query:   "\nSELECT *\nFROM\n  TABLE;\n",
+						Message: "SELECT *\nFROM\n  TABLE;",
+						PosText: "testdata/indent_golden.go:9:8",
+						Stderr:  "SELECT *\nFROM\n  TABLE;",
+					},
+					{
+						Query:   "\nSELECT *\nFROM\n  TABLE WHERE Id = @id;\n",
+						Message: "SELECT *\nFROM\n  TABLE WHERE Id = @id;",
+						PosText: "testdata/indent_golden.go:21:32",
+						Stderr:  "SELECT *\nFROM\n  TABLE WHERE Id = @id;",
+					},
+				},
+				IsChanged: false,
+			},
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY _DUMMY_VALUE_;",
-			want: "SELECT * FROM TABLE ORDER BY %v;",
+			filePath: "testdata/style.go",
+			command:  "xargs echo -n | sed -e 's/ FROM TABLE;/\\nFROM\\n  TABLE;/'",
+			replace:  true,
+			indent:   true,
+			style: LiteralStyle{
+				RawSingleLine:    true,
+				NoLeadingNewline: true,
+				IndentClosing:    true,
+			},
+			goldenFile: "testdata/style_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/style.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/style.go:9:11",
+					"testdata/style.go:15:30",
+				},
+			},
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY -999;",
-			want: "SELECT * FROM TABLE ORDER BY %d;",
+			filePath: "testdata/style_golden.go",
+			command:  "xargs echo -n | sed -e 's/ FROM TABLE;/\\nFROM\\n  TABLE;/'",
+			replace:  true,
+			indent:   true,
+			style: LiteralStyle{
+				RawSingleLine:    true,
+				NoLeadingNewline: true,
+				IndentClosing:    true,
+			},
+			goldenFile: "testdata/style_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/style_golden.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     false,
+			},
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY _DUMMY_VALUE_ _DUMMY_VALUE_;",
-			want: "SELECT * FROM TABLE ORDER BY %v %v;",
+			filePath: "testdata/indent_closing.go",
+			command:  "cat",
+			replace:  true,
+			style: LiteralStyle{
+				IndentClosing: true,
+			},
+			goldenFile: "testdata/indent_closing_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/indent_closing.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/indent_closing.go:9:11",
+				},
+			},
+		},
+		{
+			filePath: "testdata/indent_closing_golden.go",
+			command:  "cat",
+			replace:  true,
+			style: LiteralStyle{
+				IndentClosing: true,
+			},
+			goldenFile: "testdata/indent_closing_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/indent_closing_golden.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     false,
+			},
+		},
+		{
+			filePath:   "testdata/alias.go",
+			command:    "xargs echo -n | sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/alias_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/alias.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/alias.go:9:11",
+					"testdata/alias.go:16:9",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/unformatted.go",
+			command:    "xargs echo -n | sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/unformatted_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/unformatted.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/unformatted.go:9:37",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/dot_import.go",
+			command:    "xargs echo -n | sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/dot_import_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/dot_import.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/dot_import.go:9:11",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/new_statement.go",
+			command:    "xargs echo -n | sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/new_statement_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/new_statement.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/new_statement.go:10:31",
+					"testdata/new_statement.go:16:42",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/concat.go",
+			command:    "xargs echo -n | sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/concat_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/concat.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/concat.go:9:11",
+					"testdata/concat.go:16:8",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/variable.go",
+			command:    "xargs echo -n | sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/variable_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/variable.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/variable.go:8:7",
+					"testdata/variable.go:13:10",
+					"testdata/variable.go:19:13",
+					"testdata/variable.go:25:13",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/unkeyed.go",
+			command:    "xargs echo -n | sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/unkeyed_golden.go",
+			want: &ProcessResult{
+				File:          "testdata/unkeyed.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     true,
+				Unformatted: []string{
+					"testdata/unkeyed.go:8:27",
+					"testdata/unkeyed.go:12:28",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/unkeyed.go",
+			command:    `echo -n "COMMAND ERROR" 1>&2 && exit 1`,
+			replace:    false,
+			goldenFile: "testdata/unkeyed.go",
+			want: &ProcessResult{
+				File: "testdata/unkeyed.go",
+				ErrorMessages: []*ErrorMessage{
+					{
+						Query:   "SELECT * FROM TABLE;",
+						Message: "COMMAND ERROR",
+						PosText: "testdata/unkeyed.go:8:27",
+						Stderr:  "COMMAND ERROR",
+					},
+					{
+						Query:   "SELECT * FROM TABLE;",
+						Message: "COMMAND ERROR",
+						PosText: "testdata/unkeyed.go:12:28",
+						Stderr:  "COMMAND ERROR",
+					},
+				},
+				IsChanged: false,
+			},
+		},
+		{
+			filePath:   "testdata/consts/statement.go",
+			command:    "./testdata/has_error.sh",
+			replace:    true,
+			goldenFile: "testdata/consts/golden/statement.go",
+			want: &ProcessResult{
+				File: "testdata/consts/statement.go",
+				ErrorMessages: []*ErrorMessage{
+					{
+						Query:   "SELECT * FROM HAS_ERROR;",
+						Message: "COMMAND ERROR",
+						PosText: "testdata/consts/queries.go:8:16",
+						Stderr:  "COMMAND ERROR",
+					},
+				},
+				IsChanged: true,
+				Unformatted: []string{
+					"testdata/consts/statement.go:27:16",
+				},
+			},
+		},
+		{
+			filePath:   "testdata/lookalike.go",
+			command:    "xargs echo -n | sed -e 's/TABLE/TABLE_A/'",
+			replace:    true,
+			goldenFile: "testdata/lookalike.go",
+			want: &ProcessResult{
+				File:          "testdata/lookalike.go",
+				ErrorMessages: []*ErrorMessage{},
+				IsChanged:     false,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.filePath, func(t *testing.T) {
+			opts := &Options{
+				Command:    test.command,
+				Replace:    test.replace,
+				ExpandArgs: test.expandArgs,
+				Indent:     test.indent,
+				Style:      test.style,
+				Batch:      test.batch,
+				BatchSize:  test.batchSize,
+				Timeout:    test.timeout,
+			}
+			result, err := Process(context.Background(), test.filePath, opts)
+			if err != nil {
+				t.Fatalf("process(%q, %q) returned unexpected error: %v", test.filePath, test.command, err)
+			}
+
+			golden, err := os.ReadFile(test.goldenFile)
+			if err != nil {
+				t.Fatalf("failed to read golden file %s: %v", test.goldenFile, err)
+			}
+			if test.want.IsChanged {
+				test.want.Output = golden
+			}
+
+			if diff := cmp.Diff(test.want, result); diff != "" {
+				t.Errorf("process(%q, %q) returned unexpected result (-want +got):\n%s", test.filePath, test.command, diff)
+			}
+		})
+	}
+}
+
+func TestProcessFiles(t *testing.T) {
+	paths := []string{
+		"testdata/consts/queries.go",
+		"testdata/consts/statement.go",
+	}
+	command := "./testdata/has_error.sh"
+
+	opts := &Options{
+		Command: command,
+		Replace: true,
+	}
+	results, err := ProcessFiles(context.Background(), paths, opts)
+	if err != nil {
+		t.Fatalf("ProcessFiles(%q, %q) returned unexpected error: %v", paths, command, err)
+	}
+
+	want := []*ProcessResult{
+		{
+			File: "testdata/consts/queries.go",
+			ErrorMessages: []*ErrorMessage{
+				{
+					Query:   "SELECT * FROM HAS_ERROR;",
+					Message: "COMMAND ERROR",
+					PosText: "testdata/consts/queries.go:8:16",
+					Stderr:  "COMMAND ERROR",
+				},
+			},
+			IsChanged: true,
+			Unformatted: []string{
+				"testdata/consts/queries.go:3:19",
+			},
+		},
+		{
+			File:          "testdata/consts/statement.go",
+			ErrorMessages: []*ErrorMessage{},
+			IsChanged:     true,
+			Unformatted: []string{
+				"testdata/consts/statement.go:27:16",
+			},
+		},
+	}
+	goldenFiles := []string{
+		"testdata/consts/golden/queries.go",
+		"testdata/consts/golden/statement.go",
+	}
+	for i, goldenFile := range goldenFiles {
+		golden, err := os.ReadFile(goldenFile)
+		if err != nil {
+			t.Fatalf("failed to read golden file %s: %v", goldenFile, err)
+		}
+		want[i].Output = golden
+	}
+
+	if diff := cmp.Diff(want, results); diff != "" {
+		t.Errorf("ProcessFiles(%q, %q) returned unexpected result (-want +got):\n%s", paths, command, diff)
+	}
+}
+
+func TestProcessFilesError(t *testing.T) {
+	paths := []string{
+		"testdata/broken/broken.go",
+		"testdata/broken/valid.go",
+	}
+	command := "xargs echo -n | sed -e 's/TABLE/TABLE_A/'"
+
+	opts := &Options{
+		Command: command,
+		Replace: true,
+	}
+	results, err := ProcessFiles(context.Background(), paths, opts)
+	if err != nil {
+		t.Fatalf("ProcessFiles(%q, %q) returned unexpected error: %v", paths, command, err)
+	}
+	if len(results) != len(paths) {
+		t.Fatalf("ProcessFiles(%q, %q) returned %d results, want %d", paths, command, len(results), len(paths))
+	}
+	if results[0].Err == nil {
+		t.Errorf("ProcessFiles(%q, %q) returned no error for %s, want error", paths, command, paths[0])
+	}
+
+	golden, err := os.ReadFile("testdata/broken/golden/valid.go")
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	want := &ProcessResult{
+		File:          "testdata/broken/valid.go",
+		Output:        golden,
+		ErrorMessages: []*ErrorMessage{},
+		IsChanged:     true,
+		Unformatted: []string{
+			"testdata/broken/valid.go:8:30",
+		},
+	}
+	if diff := cmp.Diff(want, results[1]); diff != "" {
+		t.Errorf("ProcessFiles(%q, %q) returned unexpected result (-want +got):\n%s", paths, command, diff)
+	}
+}
+
+func TestProcessFilesCanceled(t *testing.T) {
+	paths := []string{
+		"testdata/error_only.go",
+	}
+	command := "sleep 10"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	results, err := ProcessFiles(ctx, paths, &Options{Command: command})
+	if err == nil {
+		t.Errorf("ProcessFiles(%q, %q) returned no error for a canceled context, want error: %v", paths, command, results)
+	}
+	if elapsed := time.Since(start); elapsed >= commandWaitDelay {
+		t.Errorf("ProcessFiles(%q, %q) took %s, want less than %s", paths, command, elapsed, commandWaitDelay)
+	}
+}
+
+func TestFindGoFiles(t *testing.T) {
+	files, err := FindGoFiles("testdata/filelist")
+	if err != nil {
+		t.Fatalf("findGoFiles(%q) returned unexpected error: %v", "testdata", err)
+	}
+
+	expected := []string{
+		"testdata/filelist/dir/file1.go",
+		"testdata/filelist/file1.go",
+		"testdata/filelist/file2.go",
+	}
+
+	if diff := cmp.Diff(expected, files); diff != "" {
+		t.Errorf("findGoFiles(%q) returned unexpected result (-want +got):\n%s", "testdata", diff)
+	}
+
+	if _, err := FindGoFiles("testdata/nonexistent"); err == nil {
+		t.Errorf("findGoFiles(%q) returned no error, want error", "testdata/nonexistent")
+	}
+}
+
+func TestQuoteSQL(t *testing.T) {
+	tests := []struct {
+		arg      string
+		style    LiteralStyle
+		indent   string
+		original string
+		want     string
+		wantErr  bool
+	}{
+		{
+			arg:  "SELECT * FROM TABLE_A;",
+			want: `"SELECT * FROM TABLE_A;"`,
+		},
+		{
+			arg:  "SELECT\n  *\nFROM\n  TABLE_A;",
+			want: "`\nSELECT\n  *\nFROM\n  TABLE_A;\n`",
+		},
+		{
+			arg:  `SELECT * FROM TABLE_A WHERE Name = "A\tB";`,
+			want: "`SELECT * FROM TABLE_A WHERE Name = \"A\\tB\";`",
+		},
+		{
+			arg:  "SELECT * FROM `TABLE_A` WHERE Name = \"A\";",
+			want: `"SELECT * FROM ` + "`TABLE_A`" + ` WHERE Name = \"A\";"`,
+		},
+		{
+			arg:  "SELECT\n  * -- all columns\nFROM\n  `TABLE_A`;",
+			want: "`\nSELECT\n  * -- all columns\nFROM\n  ` + \"`\" + `TABLE_A` + \"`\" + `;\n`",
+		},
+		{
+			arg:  "SELECT *\r\nFROM `TABLE_A`;",
+			want: "\"SELECT * FROM `TABLE_A`;\"",
+		},
+		{
+			arg:     "SELECT * -- all columns\r\nFROM `TABLE_A`;",
+			wantErr: true,
+		},
+		{
+			arg:  "SELECT \"a\x00b\" FROM TABLE_A;",
+			want: `"SELECT \"a\x00b\" FROM TABLE_A;"`,
+		},
+		{
+			arg:  "SELECT \"a\xffb\" FROM TABLE_A;",
+			want: `"SELECT \"a\xffb\" FROM TABLE_A;"`,
+		},
+		{
+			arg:  "SELECT\n  \"a\x00b\"\nFROM\n  TABLE_A;",
+			want: `"SELECT \"a\x00b\" FROM TABLE_A;"`,
+		},
+		{
+			arg:   "SELECT * FROM TABLE_A;",
+			style: LiteralStyle{RawSingleLine: true},
+			want:  "`SELECT * FROM TABLE_A;`",
+		},
+		{
+			arg:   "SELECT * FROM `TABLE_A`;",
+			style: LiteralStyle{RawSingleLine: true},
+			want:  `"SELECT * FROM ` + "`TABLE_A`" + `;"`,
+		},
+		{
+			arg:    "\t\tSELECT\n\t\t  *\n\t\tFROM\n\t\t  TABLE_A;",
+			style:  LiteralStyle{NoLeadingNewline: true, IndentClosing: true},
+			indent: "\t",
+			want:   "`SELECT\n\t\t  *\n\t\tFROM\n\t\t  TABLE_A;\n\t`",
+		},
+		{
+			arg:      "SELECT * FROM TABLE_A;",
+			style:    LiteralStyle{KeepKind: true},
+			original: "`SELECT * FROM TABLE;`",
+			want:     "`SELECT * FROM TABLE_A;`",
+		},
+		{
+			arg:      "SELECT\n  *\nFROM\n  TABLE_A;",
+			style:    LiteralStyle{KeepKind: true},
+			original: `"SELECT * FROM TABLE;"`,
+			want:     `"SELECT\n  *\nFROM\n  TABLE_A;"`,
+		},
+		{
+			arg:      "SELECT * FROM TABLE_A;",
+			style:    LiteralStyle{RawSingleLine: true, KeepKind: true},
+			original: `"SELECT * " + "FROM TABLE;"`,
+			want:     `"SELECT * FROM TABLE_A;"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.arg, func(t *testing.T) {
+			got, err := quoteSQL(test.arg, test.style, test.indent, test.original)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("quoteSQL(%q) returned no error, want error", test.arg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("quoteSQL(%q) returned unexpected error: %v", test.arg, err)
+			}
+			if got != test.want {
+				t.Errorf("quoteSQL(%q) = %q, want %q", test.arg, got, test.want)
+			}
+			// Collapsed SQL does not round-trip.
+			if strings.Contains(test.arg, "\r") || (strings.Contains(test.arg, "\n") && strings.HasPrefix(got, `"`)) {
+				return
+			}
+			tv, err := types.Eval(token.NewFileSet(), nil, token.NoPos, got)
+			if err != nil {
+				t.Fatalf("types.Eval(%q) returned unexpected error: %v", got, err)
+			}
+			// Multi-line SQL is written with leading and trailing newlines
+			// and indentation depending on the style.
+			if value := strings.TrimSpace(constant.StringVal(tv.Value)); value != strings.TrimSpace(test.arg) {
+				t.Errorf("types.Eval(%q) = %q, want %q", got, value, test.arg)
+			}
+		})
+	}
+}
+
+func TestFillFormatVerbs(t *testing.T) {
+	nonce := 123456
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{
+			arg:  "SELECT * FROM TABLE ORDER BY %s;",
+			want: "SELECT * FROM TABLE ORDER BY _DUMMY_STRING_123456_0_;",
+		},
+		{
+			arg:  "SELECT * FROM TABLE ORDER BY %v;",
+			want: "SELECT * FROM TABLE ORDER BY _DUMMY_VALUE_123456_0_;",
+		},
+		{
+			arg:  "SELECT * FROM TABLE ORDER BY %d;",
+			want: "SELECT * FROM TABLE ORDER BY -9991234560000;",
+		},
+		{
+			arg:  "SELECT * FROM TABLE ORDER BY %v %v;",
+			want: "SELECT * FROM TABLE ORDER BY _DUMMY_VALUE_123456_0_ _DUMMY_VALUE_123456_1_;",
+		},
+		{
+			arg:  "SELECT * FROM TABLE ORDER BY %s %s;",
+			want: "SELECT * FROM TABLE ORDER BY _DUMMY_STRING_123456_0_ _DUMMY_STRING_123456_1_;",
+		},
+		{
+			arg:  "SELECT * FROM TABLE ORDER BY %v %s;",
+			want: "SELECT * FROM TABLE ORDER BY _DUMMY_VALUE_123456_0_ _DUMMY_STRING_123456_1_;",
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY _DUMMY_STRING_ _DUMMY_STRING_;",
-			want: "SELECT * FROM TABLE ORDER BY %s %s;",
+			arg:  "SELECT * FROM TABLE WHERE Name LIKE 'A%%' ORDER BY %s;",
+			want: "SELECT * FROM TABLE WHERE Name LIKE 'A%' ORDER BY _DUMMY_STRING_123456_0_;",
 		},
 		{
-			arg:  "SELECT * FROM TABLE ORDER BY _DUMMY_VALUE_ _DUMMY_STRING_;",
-			want: "SELECT * FROM TABLE ORDER BY %v %s;",
+			arg:  "SELECT * FROM TABLE WHERE Name = %q;",
+			want: `SELECT * FROM TABLE WHERE Name = "_DUMMY_QUOTED_123456_0_";`,
+		},
+		{
+			arg:  "SELECT * FROM TABLE LIMIT %5d OFFSET %x;",
+			want: "SELECT * FROM TABLE LIMIT -9991234560000 OFFSET -9991234560001;",
+		},
+		{
+			arg:  "SELECT * FROM %-10s ORDER BY %[2]s, %[1]*d;",
+			want: "SELECT * FROM _DUMMY_STRING_123456_0_ ORDER BY _DUMMY_STRING_123456_1_, -9991234560002;",
+		},
+		{
+			arg:  "SELECT * FROM TABLE WHERE Score > %.2f;",
+			want: "SELECT * FROM TABLE WHERE Score > -9991234560000;",
+		},
+		{
+			arg:  "SELECT * FROM TABLE WHERE Rate = 100%",
+			want: "SELECT * FROM TABLE WHERE Rate = 100%",
 		},
 	}
 	for _, test := range tests {
-		t.Run(test.want, func(t *testing.T) {
-			got := restoreFormatVerbs(test.arg)
+		t.Run(test.arg, func(t *testing.T) {
+			got, _ := fillFormatVerbs(test.arg, nonce)
 			if got != test.want {
-				t.Errorf("restoreFormatVerbs(%q) = %q, want %q", test.arg, got, test.want)
+				t.Errorf("fillFormatVerbs(%q, %d) = %q, want %q", test.arg, nonce, got, test.want)
 			}
 		})
 	}
 }
 
-func TestRemoveNewlines(t *testing.T) {
+func TestFillFormatArgs(t *testing.T) {
+	dummy := func(verb *formatVerb, _ string) string {
+		return "_DUMMY_"
+	}
 	tests := []struct {
 		arg  string
+		args []constant.Value
 		want string
+	}{
+		{
+			arg:  "SELECT * FROM TABLE ORDER BY %s LIMIT %d;",
+			args: []constant.Value{constant.MakeString("CreatedAt"), constant.MakeInt64(10)},
+			want: "SELECT * FROM TABLE ORDER BY CreatedAt LIMIT 10;",
+		},
+		{
+			arg:  "SELECT * FROM TABLE ORDER BY %s LIMIT %d;",
+			args: []constant.Value{nil, constant.MakeInt64(10)},
+			want: "SELECT * FROM TABLE ORDER BY _DUMMY_ LIMIT 10;",
+		},
+		{
+			arg:  "SELECT * FROM %[2]s WHERE Name = %[1]q LIMIT %[3]d OFFSET %03d;",
+			args: []constant.Value{constant.MakeString("A"), constant.MakeString("TABLE"), constant.MakeInt64(5), constant.MakeInt64(7)},
+			want: `SELECT * FROM TABLE WHERE Name = "A" LIMIT 5 OFFSET 007;`,
+		},
+		{
+			arg:  "SELECT * FROM TABLE LIMIT %*d;",
+			args: []constant.Value{constant.MakeInt64(3), constant.MakeInt64(10)},
+			want: "SELECT * FROM TABLE LIMIT _DUMMY_;",
+		},
+		{
+			arg:  "SELECT * FROM TABLE WHERE Age = %[0]d LIMIT %d;",
+			args: []constant.Value{constant.MakeInt64(10)},
+			want: "SELECT * FROM TABLE WHERE Age = _DUMMY_ LIMIT 10;",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.arg, func(t *testing.T) {
+			got := fillFormatArgs(test.arg, test.args, dummy)
+			if got != test.want {
+				t.Errorf("fillFormatArgs(%q, %v) = %q, want %q", test.arg, test.args, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDummyKind(t *testing.T) {
+	int64Slice := types.NewSlice(types.Typ[types.Int64])
+	tests := []struct {
+		verb   rune
+		before string
+		typ    types.Type
+		want   string
+	}{
+		{verb: 's', before: "SELECT * FROM TABLE ORDER BY ", typ: types.Typ[types.String], want: DummyIdentifier},
+		{verb: 'v', before: "SELECT * FROM TABLE ORDER BY ", typ: nil, want: DummyIdentifier},
+		{verb: 's', before: "SELECT * FROM TABLE WHERE Name = '", typ: types.Typ[types.String], want: DummyString},
+		{verb: 's', before: "SELECT * FROM TABLE WHERE Name LIKE '%", typ: nil, want: DummyString},
+		{verb: 'q', before: "SELECT * FROM TABLE WHERE Name = ", typ: types.Typ[types.String], want: DummyQuoted},
+		{verb: 'd', before: "SELECT * FROM TABLE LIMIT ", typ: nil, want: DummyNumber},
+		{verb: 'd', before: "SELECT * FROM TABLE LIMIT ", typ: types.Typ[types.Invalid], want: DummyNumber},
+		{verb: 'v', before: "SELECT * FROM TABLE LIMIT ", typ: types.Typ[types.Int], want: DummyNumber},
+		{verb: 'v', before: "SELECT * FROM TABLE WHERE Deleted = ", typ: types.Typ[types.Bool], want: DummyBool},
+		{verb: 's', before: "SELECT * FROM TABLE WHERE Id IN (", typ: types.Typ[types.String], want: DummyStringList},
+		{verb: 'd', before: "SELECT * FROM TABLE WHERE Id in(", typ: nil, want: DummyNumberList},
+		{verb: 'v', before: "SELECT * FROM TABLE WHERE Id IN UNNEST([", typ: int64Slice, want: DummyNumberList},
+		{verb: 's', before: "SELECT * FROM TABLE@{", typ: types.Typ[types.String], want: DummyHint},
+	}
+	for _, test := range tests {
+		t.Run(test.before, func(t *testing.T) {
+			got := dummyKind(test.verb, test.before, test.typ)
+			if got != test.want {
+				t.Errorf("dummyKind(%q, %q, %v) = %q, want %q", test.verb, test.before, test.typ, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDummyValue(t *testing.T) {
+	values := map[string]string{
+		DummyIdentifier: "CreatedAt",
+	}
+	before := "SELECT * FROM TABLE ORDER BY "
+	if got, want := dummyValue(values, 's', before, nil), "CreatedAt"; got != want {
+		t.Errorf("dummyValue(%v, 's', %q, nil) = %q, want %q", values, before, got, want)
+	}
+	before = "SELECT * FROM TABLE LIMIT "
+	if got, want := dummyValue(values, 'd', before, nil), "1"; got != want {
+		t.Errorf("dummyValue(%v, 'd', %q, nil) = %q, want %q", values, before, got, want)
+	}
+}
+
+func TestNewNonce(t *testing.T) {
+	sql := "SELECT * FROM TABLE WHERE Id = -999 ORDER BY %d;"
+	for i := 0; i < 100; i++ {
+		nonce := newNonce(sql)
+		filled, verbs := fillFormatVerbs(sql, nonce)
+		if got := strings.Count(filled, verbs[0].placeholder); got != 1 {
+			t.Fatalf("placeholder %s appears %d times in %q, want 1", verbs[0].placeholder, got, filled)
+		}
+	}
+}
+
+func TestRestoreFormatVerbs(t *testing.T) {
+	nonce := 123456
+	tests := []struct {
+		format  string
+		arg     string
+		want    string
+		wantErr bool
+	}{
+		{
+			format: "SELECT * FROM TABLE ORDER BY %s;",
+			arg:    "SELECT * FROM TABLE_A ORDER BY _DUMMY_STRING_123456_0_;",
+			want:   "SELECT * FROM TABLE_A ORDER BY %s;",
+		},
+		{
+			format: "SELECT * FROM TABLE ORDER BY %v %s;",
+			arg:    "SELECT * FROM TABLE_A ORDER BY _DUMMY_VALUE_123456_0_ _DUMMY_STRING_123456_1_;",
+			want:   "SELECT * FROM TABLE_A ORDER BY %v %s;",
+		},
+		{
+			format: "SELECT * FROM TABLE WHERE Id = -999 ORDER BY %d;",
+			arg:    "SELECT * FROM TABLE_A WHERE Id = -999 ORDER BY -9991234560000;",
+			want:   "SELECT * FROM TABLE_A WHERE Id = -999 ORDER BY %d;",
+		},
+		{
+			format: "SELECT * FROM TABLE WHERE Name LIKE 'A%%' ORDER BY %s;",
+			arg:    "SELECT * FROM TABLE_A WHERE Name LIKE 'A%' ORDER BY _DUMMY_STRING_123456_0_;",
+			want:   "SELECT * FROM TABLE_A WHERE Name LIKE 'A%%' ORDER BY %s;",
+		},
+		{
+			format: "SELECT * FROM TABLE WHERE Name = %q;",
+			arg:    `SELECT * FROM TABLE_A WHERE Name = "_DUMMY_QUOTED_123456_0_";`,
+			want:   "SELECT * FROM TABLE_A WHERE Name = %q;",
+		},
+		{
+			format: "SELECT * FROM %-10s ORDER BY %[2]s, %[1]*d;",
+			arg:    "SELECT * FROM _DUMMY_STRING_123456_0_ ORDER BY _DUMMY_STRING_123456_1_, -9991234560002;",
+			want:   "SELECT * FROM %-10s ORDER BY %[2]s, %[1]*d;",
+		},
+		{
+			format: "SELECT * FROM %s ORDER BY %s;",
+			arg:    "SELECT * FROM _DUMMY_STRING_123456_1_ ORDER BY _DUMMY_STRING_123456_0_;",
+			want:   "SELECT * FROM %s ORDER BY %s;",
+		},
+		{
+			format:  "SELECT * FROM TABLE ORDER BY %s;",
+			arg:     "SELECT * FROM TABLE_A;",
+			wantErr: true,
+		},
+		{
+			format:  "SELECT * FROM TABLE ORDER BY %s;",
+			arg:     "SELECT * FROM TABLE_A ORDER BY _DUMMY_STRING_123456_0_, _DUMMY_STRING_123456_0_;",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.arg, func(t *testing.T) {
+			_, verbs := fillFormatVerbs(test.format, nonce)
+			got, err := restoreFormatVerbs(test.arg, verbs)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("restoreFormatVerbs(%q) returned no error, want error", test.arg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("restoreFormatVerbs(%q) returned unexpected error: %v", test.arg, err)
+			}
+			if got != test.want {
+				t.Errorf("restoreFormatVerbs(%q) = %q, want %q", test.arg, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRemoveNewlines(t *testing.T) {
+	tests := []struct {
+		arg     string
+		want    string
+		wantErr bool
 	}{
 		{
 			arg:  "SELECT * FROM TABLE;",
@@ -313,14 +1264,402 @@ ORDER BY
 `,
 			want: "SELECT * FROM TABLE ORDER BY CreatedAt;",
 		},
+		{
+			arg: `
+SELECT
+  * /* all
+  columns */
+FROM
+  TABLE
+WHERE
+  Name = 'A B';
+`,
+			want: "SELECT * /* all columns */ FROM TABLE WHERE Name = 'A B';",
+		},
+		{
+			arg: `
+SELECT
+  *
+FROM
+  TABLE; -- comment
+`,
+			want: "SELECT * FROM TABLE; -- comment",
+		},
+		{
+			arg: `
+SELECT
+  * -- all columns
+FROM
+  TABLE;
+`,
+			wantErr: true,
+		},
+		{
+			arg: `
+SELECT
+  *
+FROM
+  TABLE
+WHERE
+  Name = 'A  B';
+`,
+			wantErr: true,
+		},
+		{
+			arg: `
+SELECT
+  *
+FROM
+  TABLE
+WHERE
+  Name = """A
+B""";
+`,
+			wantErr: true,
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.arg, func(t *testing.T) {
-			got := removeNewlines(test.arg)
+			got, err := removeNewlines(test.arg)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("removeNewlines(%q) returned no error, want error", test.arg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("removeNewlines(%q) returned unexpected error: %v", test.arg, err)
+			}
 			if got != test.want {
 				t.Errorf("removeNewlines(%q) = %q, want %q", test.arg, got, test.want)
 			}
 		})
 	}
 }
+
+func equalConstant(x, y constant.Value) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+	return x.ExactString() == y.ExactString()
+}
+
+func TestArgCombinations(t *testing.T) {
+	createdAt := constant.MakeString("CreatedAt")
+	name := constant.MakeString("Name")
+	limit := constant.MakeInt64(10)
+
+	tests := []struct {
+		name   string
+		args   [][]constant.Value
+		expand bool
+		want   [][]constant.Value
+	}{
+		{
+			name:   "constants",
+			args:   [][]constant.Value{{createdAt}, {limit}},
+			expand: false,
+			want:   [][]constant.Value{{createdAt, limit}},
+		},
+		{
+			name:   "unknown",
+			args:   [][]constant.Value{nil, {limit}},
+			expand: true,
+			want:   [][]constant.Value{{nil, limit}},
+		},
+		{
+			name:   "set without expand",
+			args:   [][]constant.Value{{createdAt, name}, {limit}},
+			expand: false,
+			want:   [][]constant.Value{{nil, limit}},
+		},
+		{
+			name:   "set with expand",
+			args:   [][]constant.Value{{createdAt, name}, {limit}},
+			expand: true,
+			want:   [][]constant.Value{{createdAt, limit}, {name, limit}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := argCombinations(test.args, test.expand)
+			if diff := cmp.Diff(test.want, got, cmp.Comparer(equalConstant)); diff != "" {
+				t.Errorf("argCombinations(%v, %t) returned unexpected result (-want +got):\n%s", test.args, test.expand, diff)
+			}
+		})
+	}
+}
+
+func TestDedentSQL(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{
+			arg:  "SELECT * FROM TABLE;",
+			want: "SELECT * FROM TABLE;",
+		},
+		{
+			arg:  "\n\t\tSELECT\n\t\t  *\n\n\t\tFROM\n\t\t  TABLE;\n\t",
+			want: "\nSELECT\n  *\n\nFROM\n  TABLE;\n",
+		},
+		{
+			arg:  "\n    SELECT *\n  FROM TABLE;\n",
+			want: "\n  SELECT *\nFROM TABLE;\n",
+		},
+		{
+			arg:  "SELECT *\n\t\tFROM\n\t\t  TABLE;\n\t",
+			want: "SELECT *\nFROM\n  TABLE;\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.arg, func(t *testing.T) {
+			got := dedentSQL(test.arg)
+			if got != test.want {
+				t.Errorf("dedentSQL(%q) = %q, want %q", test.arg, got, test.want)
+			}
+			if indented := indentSQL(got, "\t"); dedentSQL(indented) != got {
+				t.Errorf("dedentSQL(indentSQL(%q, %q)) = %q, want %q", got, "\t", dedentSQL(indented), got)
+			}
+		})
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		old  string
+		new  string
+		want string
+	}{
+		{
+			name: "equal",
+			old:  "a\nb\n",
+			new:  "a\nb\n",
+			want: "",
+		},
+		{
+			name: "changed line",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n",
+			new:  "1\n2\n3\n4\nfive\n6\n7\n8\n",
+			want: "--- a/file.go\n+++ b/file.go\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name: "separate hunks",
+			old:  "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			new:  "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\neleven\n",
+			want: "--- a/file.go\n+++ b/file.go\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -8,3 +8,4 @@\n 8\n 9\n 10\n+eleven\n",
+		},
+		{
+			name: "no newline at end of file",
+			old:  "a\nb",
+			new:  "a\nc",
+			want: "--- a/file.go\n+++ b/file.go\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+		{
+			name: "moved lines",
+			old:  "a\nb\nc\na\nb\nb\na\n",
+			new:  "c\nb\na\nb\na\nc\n",
+			want: "--- a/file.go\n+++ b/file.go\n@@ -1,7 +1,6 @@\n-a\n+c\n b\n-c\n a\n b\n-b\n a\n+c\n",
+		},
+		{
+			name: "absolute path",
+			path: "/src/file.go",
+			old:  "a\n",
+			new:  "b\n",
+			want: "--- /src/file.go\n+++ /src/file.go\n@@ -1 +1 @@\n-a\n+b\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := test.path
+			if path == "" {
+				path = "file.go"
+			}
+			got := Diff(path, []byte(test.old), []byte(test.new))
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Errorf("Diff() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The processes started by the command keep its output open until the
+	// whole process group is killed.
+	start := time.Now()
+	r, err := RunCommand(ctx, "sleep 10 | cat", "SELECT 1;")
+	if err != nil {
+		t.Fatalf("RunCommand() returned unexpected error: %v", err)
+	}
+	if !r.TimedOut {
+		t.Errorf("RunCommand() returned a result not timed out: %+v", r)
+	}
+	if elapsed := time.Since(start); elapsed >= commandWaitDelay {
+		t.Errorf("RunCommand() took %s, want less than %s", elapsed, commandWaitDelay)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := RunCommand(canceled, "cat", "SELECT 1;"); err == nil {
+		t.Errorf("RunCommand() returned no error for a canceled context, want error")
+	}
+
+	// A chunk that times out is not run again query by query.
+	opts := &Options{
+		Command: "sleep 10",
+		Batch:   BatchNUL,
+		Timeout: 100 * time.Millisecond,
+	}
+	jobs := make([]*commandJob, 0)
+	for _, query := range []string{"SELECT 1;", "SELECT 2;", "SELECT 3;", "SELECT 4;"} {
+		jobs = append(jobs, &commandJob{query: query})
+	}
+	start = time.Now()
+	runBatch(context.Background(), opts, jobs)
+	if elapsed := time.Since(start); elapsed >= 2*opts.Timeout {
+		t.Errorf("runBatch() took %s, want less than %s", elapsed, 2*opts.Timeout)
+	}
+	for _, job := range jobs {
+		if job.err != nil || !job.result.TimedOut {
+			t.Errorf("runBatch() returned a result not timed out for %q: %+v, %v", job.query, job.result, job.err)
+		}
+	}
+}
+
+func TestRunCommands(t *testing.T) {
+	queries := []string{"SELECT 1;", "SELECT 2;", "SELECT 3;", "SELECT 4;", "SELECT 5;"}
+	for _, n := range []int{0, 1, 2, len(queries) + 1} {
+		jobs := make([]*commandJob, 0, len(queries))
+		for _, query := range queries {
+			jobs = append(jobs, &commandJob{query: query})
+		}
+
+		runCommands(context.Background(), jobs, &Options{Command: "cat", Jobs: n})
+
+		for _, job := range jobs {
+			if job.err != nil {
+				t.Fatalf("runCommands(n=%d) returned unexpected error for %q: %v", n, job.query, job.err)
+			}
+			if job.result.Output != job.query {
+				t.Errorf("runCommands(n=%d) output = %q, want %q", n, job.result.Output, job.query)
+			}
+		}
+	}
+}
+
+func TestChunkJobs(t *testing.T) {
+	jobs := make([]*commandJob, 5)
+	tests := []struct {
+		size int
+		n    int
+		want []int
+	}{
+		{size: 0, n: 1, want: []int{5}},
+		{size: 0, n: 2, want: []int{3, 2}},
+		{size: 0, n: 8, want: []int{1, 1, 1, 1, 1}},
+		{size: 2, n: 8, want: []int{2, 2, 1}},
+	}
+
+	for _, test := range tests {
+		chunks := chunkJobs(jobs, test.size, test.n)
+		got := make([]int, 0, len(chunks))
+		for _, chunk := range chunks {
+			got = append(got, len(chunk))
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("chunkJobs(size=%d, n=%d) returned unexpected chunk sizes (-want +got):\n%s", test.size, test.n, diff)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	stub := filepath.Join(t.TempDir(), "stubformatter")
+	if output, err := exec.Command("go", "build", "-o", stub, "./testdata/stubformatter").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build stub formatter: %v\n%s", err, output)
+	}
+
+	server := NewServer(stub, 2)
+	var stderr bytes.Buffer
+	server.Stderr = &stderr
+	defer server.Close()
+
+	opts := &Options{
+		Replace: true,
+		Server:  server,
+	}
+	result, err := Process(context.Background(), "testdata/has_error.go", opts)
+	if err != nil {
+		t.Fatalf("Process() returned unexpected error: %v", err)
+	}
+	golden, err := os.ReadFile("testdata/has_error_golden.go")
+	if err != nil {
+		t.Fatalf("failed to read golden file: %v", err)
+	}
+	want := &ProcessResult{
+		File:   "testdata/has_error.go",
+		Output: golden,
+		ErrorMessages: []*ErrorMessage{
+			{
+				Query:   "SELECT * FROM HAS_ERROR;",
+				Message: "COMMAND ERROR",
+				PosText: "testdata/has_error.go:16:11",
+				Stderr:  "COMMAND ERROR",
+			},
+		},
+		IsChanged: true,
+		Unformatted: []string{
+			"testdata/has_error.go:9:11",
+		},
+	}
+	if diff := cmp.Diff(want, result); diff != "" {
+		t.Errorf("Process() returned unexpected result (-want +got):\n%s", diff)
+	}
+
+	// A crashed process is restarted for the next query.
+	if _, err := server.Format(context.Background(), "SELECT CRASH;", "fmt", ""); err == nil {
+		t.Errorf("Format() returned no error for a crashing query, want error")
+	}
+	r, err := server.Format(context.Background(), "SELECT * FROM TABLE;", "fmt", "")
+	if err != nil {
+		t.Fatalf("Format() returned unexpected error after a crash: %v", err)
+	}
+	if want := "SELECT * FROM TABLE_A;"; r.Output != want {
+		t.Errorf("Format() = %q, want %q", r.Output, want)
+	}
+
+	// A process that does not respond in time is killed.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r, err = server.Format(ctx, "SELECT SLEEP;", "fmt", "")
+	if err != nil {
+		t.Fatalf("Format() returned unexpected error for a slow query: %v", err)
+	}
+	if !r.TimedOut {
+		t.Errorf("Format() returned a result not timed out for a slow query: %+v", r)
+	}
+	if _, err := server.Format(context.Background(), "SELECT * FROM TABLE;", "fmt", ""); err != nil {
+		t.Fatalf("Format() returned unexpected error after a timeout: %v", err)
+	}
+
+	// What the processes write to the standard error is forwarded.
+	if _, err := server.Format(context.Background(), "SELECT WARN;", "fmt", ""); err != nil {
+		t.Fatalf("Format() returned unexpected error for a query with a warning: %v", err)
+	}
+
+	server.Close()
+	if n := len(server.slots); n != 0 {
+		t.Errorf("Close() left %d processes running", n)
+	}
+	if want := "COMMAND WARNING\n"; stderr.String() != want {
+		t.Errorf("Stderr = %q, want %q", stderr.String(), want)
+	}
+}
@@ -0,0 +1,18 @@
+package format
+
+import (
+	sp "cloud.google.com/go/spanner"
+)
+
+func SQL() *sp.Statement {
+	return &sp.Statement{
+		SQL:    "SELECT * FROM TABLE_A;",
+		Params: map[string]interface{}{},
+	}
+}
+
+func Statements() []sp.Statement {
+	return []sp.Statement{
+		{SQL: "SELECT * FROM TABLE_A;"},
+	}
+}
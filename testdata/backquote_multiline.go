@@ -0,0 +1,12 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func BackquoteMultilineSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL:    "SELECT * FROM `TABLE` WHERE Id = @id;",
+		Params: map[string]interface{}{},
+	}
+}
@@ -0,0 +1,18 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func BackquoteMultilineSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL: `
+SELECT *
+FROM
+  ` + "`" + `TABLE_A` + "`" + `
+WHERE -- filter
+  Id = @id;
+`,
+		Params: map[string]interface{}{},
+	}
+}
@@ -0,0 +1,14 @@
+#!/bin/bash
+
+# Replaces TABLE with TABLE_A in each NUL-terminated query, and fails if any
+# query contains HAS_ERROR.
+
+input=$(mktemp)
+trap 'rm -f "$input"' EXIT
+cat >"$input"
+
+if grep -qa "HAS_ERROR" "$input"; then
+	echo -n "COMMAND ERROR" 1>&2
+	exit 1
+fi
+sed -z -e 's/TABLE/TABLE_A/g' "$input"
@@ -0,0 +1,9 @@
+package broken
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func Valid() spanner.Statement {
+	return spanner.NewStatement("SELECT * FROM TABLE_A;")
+}
@@ -0,0 +1,21 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func SQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL:    "SELECT * FROM TABLE " + "WHERE Id = @id;",
+		Params: map[string]interface{}{},
+	}
+}
+
+func MultilineSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL: "SELECT * " +
+			"FROM TABLE " +
+			"WHERE Id = @id;",
+		Params: map[string]interface{}{},
+	}
+}
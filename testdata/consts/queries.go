@@ -0,0 +1,9 @@
+package consts
+
+const listQuery = "SELECT * FROM TABLE;"
+
+const (
+	baseQuery   = "SELECT * FROM TABLE"
+	filterQuery = baseQuery + " WHERE Id = @id;"
+	errorQuery  = "SELECT * FROM HAS_ERROR;"
+)
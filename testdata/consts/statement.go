@@ -0,0 +1,29 @@
+package consts
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func List() spanner.Statement {
+	return spanner.Statement{SQL: listQuery}
+}
+
+func ListAgain() spanner.Statement {
+	return spanner.NewStatement(listQuery)
+}
+
+func Filter() *spanner.Statement {
+	return &spanner.Statement{
+		SQL:    filterQuery,
+		Params: map[string]interface{}{"id": 1},
+	}
+}
+
+func Error() spanner.Statement {
+	return spanner.NewStatement(errorQuery)
+}
+
+func Local() spanner.Statement {
+	const query = "SELECT * FROM TABLE;"
+	return spanner.NewStatement(query)
+}
@@ -0,0 +1,12 @@
+package format
+
+import (
+	. "cloud.google.com/go/spanner"
+)
+
+func SQL() *Statement {
+	return &Statement{
+		SQL:    "SELECT * FROM TABLE_A;",
+		Params: map[string]interface{}{},
+	}
+}
@@ -0,0 +1,19 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func EscapeSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL:    `SELECT * FROM TABLE_A WHERE Name = "A\tB";`,
+		Params: map[string]interface{}{},
+	}
+}
+
+func BackquoteEscapeSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL:    "SELECT * FROM `TABLE_A` WHERE Name = \"A\";",
+		Params: map[string]interface{}{},
+	}
+}
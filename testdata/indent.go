@@ -0,0 +1,21 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func IndentSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL:    "SELECT * FROM TABLE;",
+		Params: map[string]interface{}{},
+	}
+}
+
+func NestedIndentSQL() func() spanner.Statement {
+	return func() spanner.Statement {
+		if true {
+			return spanner.NewStatement("SELECT * FROM TABLE WHERE Id = @id;")
+		}
+		return spanner.Statement{}
+	}
+}
@@ -0,0 +1,12 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func IndentClosingSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL:    "SELECT *\nFROM\n  TABLE;",
+		Params: map[string]interface{}{},
+	}
+}
@@ -0,0 +1,16 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func IndentClosingSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL: `
+SELECT *
+FROM
+  TABLE;
+		`,
+		Params: map[string]interface{}{},
+	}
+}
@@ -0,0 +1,21 @@
+package format
+
+import (
+	"example.com/spanner"
+)
+
+type Statement struct {
+	SQL string
+}
+
+func SQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL: "SELECT * FROM TABLE;",
+	}
+}
+
+func LocalSQL() *Statement {
+	return &Statement{
+		SQL: "SELECT * FROM TABLE;",
+	}
+}
@@ -9,7 +9,8 @@ func SQL1() *spanner.Statement {
 		SQL: `
 SELECT * FROM 
 TABLE_A;
-`, Params: map[string]interface{}{},
+`,
+		Params: map[string]interface{}{},
 	}
 }
 
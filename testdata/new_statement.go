@@ -0,0 +1,17 @@
+package format
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/spanner"
+)
+
+func SQL() spanner.Statement {
+	stmt := spanner.NewStatement("SELECT * FROM TABLE WHERE Id = @id;")
+	stmt.Params["id"] = 1
+	return stmt
+}
+
+func SprintfSQL() spanner.Statement {
+	return spanner.NewStatement(fmt.Sprintf("SELECT * FROM TABLE ORDER BY %s;", "CreatedAt"))
+}
@@ -0,0 +1,38 @@
+package format
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/spanner"
+)
+
+const orderColumn = "CreatedAt"
+
+func ArgsSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL:    fmt.Sprintf("SELECT * FROM TABLE ORDER BY %s LIMIT %d;", orderColumn, 10),
+		Params: map[string]interface{}{},
+	}
+}
+
+func ArgSetSQL(byName bool) *spanner.Statement {
+	column := "CreatedAt"
+	if byName {
+		column = "Name"
+	}
+	return &spanner.Statement{
+		SQL:    fmt.Sprintf("SELECT * FROM TABLE ORDER BY %s;", column),
+		Params: map[string]interface{}{},
+	}
+}
+
+func ZeroArgSQL(desc bool) *spanner.Statement {
+	var order string
+	if desc {
+		order = " DESC"
+	}
+	return &spanner.Statement{
+		SQL:    fmt.Sprintf("SELECT * FROM TABLE ORDER BY Id%s;", order),
+		Params: map[string]interface{}{},
+	}
+}
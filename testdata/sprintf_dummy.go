@@ -0,0 +1,18 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/spanner"
+)
+
+func DummySQL(index string, ids []int64, names []string, kind, column string, limit int) *spanner.Statement {
+	return &spanner.Statement{
+		SQL: fmt.Sprintf(
+			"SELECT * FROM TABLE@{%s} WHERE Id IN (%s) AND Name IN (%s) AND Kind = '%s' ORDER BY %s LIMIT %v;",
+			index, strings.Trim(fmt.Sprint(ids), "[]"), strings.Join(names, ", "), kind, column, limit,
+		),
+		Params: map[string]interface{}{},
+	}
+}
@@ -0,0 +1,14 @@
+package format
+
+import (
+	"fmt"
+
+	"cloud.google.com/go/spanner"
+)
+
+func VerbsSQL(name string, limit int) *spanner.Statement {
+	return &spanner.Statement{
+		SQL:    fmt.Sprintf("SELECT * FROM TABLE_A WHERE Name LIKE '%%%s%%' AND Kind = %q LIMIT %5d OFFSET %[3]d;", name, "kind", limit),
+		Params: map[string]interface{}{},
+	}
+}
@@ -0,0 +1,74 @@
+// Command stubformatter is a formatter server for tests of spqex.Server.
+// It replaces TABLE with TABLE_A in the SQL, reports an error for SQL with
+// HAS_ERROR, crashes on SQL with CRASH and hangs on SQL with SLEEP. SQL with
+// WARN is formatted with a warning on the standard error.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type request struct {
+	ID     int    `json:"id"`
+	Method string `json:"method"`
+	Params struct {
+		SQL      string `json:"sql"`
+		Mode     string `json:"mode"`
+		Position string `json:"position"`
+	} `json:"params"`
+}
+
+type response struct {
+	ID     int     `json:"id"`
+	Result any     `json:"result,omitempty"`
+	Error  *rpcErr `json:"error,omitempty"`
+}
+
+type rpcErr struct {
+	Message string `json:"message"`
+}
+
+func main() {
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid request: %v\n", err)
+			os.Exit(1)
+		}
+
+		res := &response{ID: req.ID}
+		switch req.Method {
+		case "format":
+			sql := strings.TrimSpace(req.Params.SQL)
+			switch {
+			case strings.Contains(sql, "CRASH"):
+				os.Exit(2)
+			case strings.Contains(sql, "SLEEP"):
+				time.Sleep(time.Hour)
+			case strings.Contains(sql, "HAS_ERROR"):
+				res.Error = &rpcErr{Message: "COMMAND ERROR"}
+			case strings.Contains(sql, "WARN"):
+				fmt.Fprintln(os.Stderr, "COMMAND WARNING")
+				res.Result = map[string]string{"sql": sql}
+			default:
+				res.Result = map[string]string{"sql": strings.ReplaceAll(sql, "TABLE", "TABLE_A")}
+			}
+		case "shutdown":
+			res.Result = map[string]string{}
+			_ = encoder.Encode(res)
+			return
+		default:
+			res.Error = &rpcErr{Message: fmt.Sprintf("unknown method %q", req.Method)}
+		}
+		if err := encoder.Encode(res); err != nil {
+			os.Exit(1)
+		}
+	}
+}
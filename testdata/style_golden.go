@@ -0,0 +1,19 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func StyleSQL() *spanner.Statement {
+	return &spanner.Statement{
+		SQL: `SELECT *
+			FROM
+			  TABLE;
+		`,
+		Params: map[string]interface{}{},
+	}
+}
+
+func SingleLineStyleSQL() spanner.Statement {
+	return spanner.NewStatement(`SELECT Id FROM TABLE WHERE Id = @id;`)
+}
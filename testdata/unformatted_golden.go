@@ -0,0 +1,11 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+// UnformattedSQL is not formatted with gofmt.
+func UnformattedSQL()   *spanner.Statement {
+    stmt := spanner.Statement{ SQL: "SELECT * FROM TABLE_A;", /* params */ Params: map[string]interface{}{} }
+	return &stmt   // statement
+}
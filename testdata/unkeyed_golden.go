@@ -0,0 +1,13 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func UnkeyedSQL() spanner.Statement {
+	return spanner.Statement{"SELECT * FROM TABLE_A;", nil}
+}
+
+func UnkeyedPointerSQL() *spanner.Statement {
+	return &spanner.Statement{"SELECT * FROM TABLE_A;", map[string]interface{}{}}
+}
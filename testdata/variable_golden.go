@@ -0,0 +1,50 @@
+package format
+
+import (
+	"cloud.google.com/go/spanner"
+)
+
+func DefineSQL() spanner.Statement {
+	q := "SELECT * FROM TABLE_A;"
+	return spanner.Statement{SQL: q}
+}
+
+func VarSQL() spanner.Statement {
+	var q = "SELECT * FROM TABLE_A;"
+	return spanner.NewStatement(q)
+}
+
+func FieldSQL() spanner.Statement {
+	stmt := spanner.Statement{}
+	stmt.SQL = "SELECT * FROM TABLE_A;"
+	return stmt
+}
+
+func PointerFieldSQL() *spanner.Statement {
+	stmt := &spanner.Statement{Params: map[string]interface{}{}}
+	stmt.SQL = "SELECT * FROM TABLE_A;"
+	return stmt
+}
+
+func ReassignedSQL(desc bool) spanner.Statement {
+	q := "SELECT * FROM TABLE;"
+	if desc {
+		q = "SELECT * FROM TABLE ORDER BY Id DESC;"
+	}
+	return spanner.Statement{SQL: q}
+}
+
+func ParamSQL(q string, all bool) spanner.Statement {
+	if all {
+		q = "SELECT * FROM TABLE;"
+	}
+	return spanner.Statement{SQL: q}
+}
+
+func ZeroValueSQL(all bool) spanner.Statement {
+	var q string
+	if all {
+		q = "SELECT * FROM TABLE;"
+	}
+	return spanner.Statement{SQL: q}
+}
@@ -0,0 +1,151 @@
+package spqex
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"path"
+	"strings"
+)
+
+const spannerPkgPath = "cloud.google.com/go/spanner"
+
+// stubImporter resolves imports without building any dependency.
+// cloud.google.com/go/spanner is replaced by a minimal package declaring
+// Statement and NewStatement, and every other import path by an empty
+// package, so that identifiers can be resolved even when the dependencies
+// are not available.
+type stubImporter struct {
+	pkgs map[string]*types.Package
+}
+
+func newStubImporter() *stubImporter {
+	return &stubImporter{
+		pkgs: make(map[string]*types.Package),
+	}
+}
+
+func (i *stubImporter) Import(importPath string) (*types.Package, error) {
+	if pkg, ok := i.pkgs[importPath]; ok {
+		return pkg, nil
+	}
+
+	var pkg *types.Package
+	if importPath == spannerPkgPath {
+		pkg = newSpannerPackage()
+	} else {
+		pkg = types.NewPackage(importPath, guessPackageName(importPath))
+		pkg.MarkComplete()
+	}
+	i.pkgs[importPath] = pkg
+	return pkg, nil
+}
+
+func guessPackageName(importPath string) string {
+	name := path.Base(importPath)
+	// Major version suffix like example.com/foo/v2
+	if len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = path.Base(path.Dir(importPath))
+	}
+	name = strings.TrimPrefix(name, "go-")
+	name = strings.TrimSuffix(name, ".go")
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+func newSpannerPackage() *types.Package {
+	pkg := types.NewPackage(spannerPkgPath, "spanner")
+
+	params := types.NewMap(types.Typ[types.String], types.NewInterfaceType(nil, nil))
+	fields := []*types.Var{
+		types.NewField(token.NoPos, pkg, "SQL", types.Typ[types.String], false),
+		types.NewField(token.NoPos, pkg, "Params", params, false),
+	}
+	obj := types.NewTypeName(token.NoPos, pkg, "Statement", nil)
+	statement := types.NewNamed(obj, types.NewStruct(fields, nil), nil)
+	pkg.Scope().Insert(obj)
+
+	sig := types.NewSignatureType(nil, nil, nil,
+		types.NewTuple(types.NewParam(token.NoPos, pkg, "sql", types.Typ[types.String])),
+		types.NewTuple(types.NewParam(token.NoPos, pkg, "", statement)),
+		false,
+	)
+	pkg.Scope().Insert(types.NewFunc(token.NoPos, pkg, "NewStatement", sig))
+
+	pkg.MarkComplete()
+	return pkg
+}
+
+// typeCheck type checks files and returns the collected information.
+// Type errors are ignored because imported packages are only stubs.
+func typeCheck(fset *token.FileSet, files []*ast.File) *types.Info {
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{
+		Importer: newStubImporter(),
+		Error:    func(error) {},
+	}
+	pkgName := ""
+	if len(files) > 0 {
+		pkgName = files[0].Name.Name
+	}
+	_, _ = conf.Check(pkgName, fset, files, info)
+	return info
+}
+
+func isSpannerStatement(typ types.Type) bool {
+	if ptr, ok := typ.(*types.Pointer); ok {
+		typ = ptr.Elem()
+	}
+	named, ok := typ.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == spannerPkgPath && obj.Name() == "Statement"
+}
+
+// sqlFieldIndex returns the index of the SQL field in the spanner.Statement
+// struct, which is the position of the SQL in an unkeyed literal.
+func sqlFieldIndex(typ types.Type) (int, bool) {
+	if ptr, ok := typ.(*types.Pointer); ok {
+		typ = ptr.Elem()
+	}
+	st, ok := typ.Underlying().(*types.Struct)
+	if !ok {
+		return 0, false
+	}
+	for i := 0; i < st.NumFields(); i++ {
+		if st.Field(i).Name() == "SQL" {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// isPackageFunc reports whether expr refers to the function name in the
+// package with the given import path.
+func isPackageFunc(info *types.Info, expr ast.Expr, pkgPath, name string) bool {
+	switch expr := expr.(type) {
+	case *ast.SelectorExpr:
+		pkgIdent, ok := expr.X.(*ast.Ident)
+		if !ok {
+			return false
+		}
+		pkgName, ok := info.Uses[pkgIdent].(*types.PkgName)
+		if !ok {
+			return false
+		}
+		return pkgName.Imported().Path() == pkgPath && expr.Sel.Name == name
+	case *ast.Ident:
+		// Dot import
+		obj, ok := info.Uses[expr].(*types.Func)
+		if !ok {
+			return false
+		}
+		return obj.Pkg() != nil && obj.Pkg().Path() == pkgPath && obj.Name() == name
+	}
+	return false
+}
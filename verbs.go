@@ -0,0 +1,304 @@
+package spqex
+
+import (
+	"fmt"
+	"go/constant"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var argIndexPattern = regexp.MustCompile(`\[\d+\]`)
+
+// formatVerb is a verb in a fmt format string such as %s, %-10s or %[2]d.
+type formatVerb struct {
+	// raw is the verb as written in the format string.
+	raw string
+	// verb is the verb character like 's' or 'd'.
+	verb rune
+	// arg is the index of the argument formatted by the verb.
+	arg int
+	// placeholder is the token the verb is replaced with while the SQL is
+	// passed to the command.
+	placeholder string
+}
+
+// formatPart is either literal text or a verb of a format string.
+type formatPart struct {
+	text string
+	verb *formatVerb
+}
+
+// parseFormat splits a fmt format string into literal text and verbs,
+// following the syntax of the fmt package: flags, width, precision,
+// explicit argument indexes and %% for a literal percent sign.
+func parseFormat(format string) []*formatPart {
+	parts := make([]*formatPart, 0)
+	// argNum is the index of the next argument to format.
+	argNum := 0
+	var text strings.Builder
+	flushText := func() {
+		if text.Len() > 0 {
+			parts = append(parts, &formatPart{text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(format); {
+		if format[i] != '%' {
+			text.WriteByte(format[i])
+			i++
+			continue
+		}
+
+		end, verb, ok := scanVerb(format, i+1)
+		if !ok {
+			// A trailing % without verb is kept as is.
+			text.WriteString(format[i:])
+			break
+		}
+		if verb == '%' {
+			text.WriteByte('%')
+		} else {
+			flushText()
+			raw := format[i:end]
+			var arg int
+			arg, argNum = verbArg(raw, argNum)
+			parts = append(parts, &formatPart{
+				verb: &formatVerb{
+					raw:  raw,
+					verb: verb,
+					arg:  arg,
+				},
+			})
+		}
+		i = end
+	}
+	flushText()
+
+	return parts
+}
+
+// scanVerb scans the flags, width, precision and argument indexes of a verb
+// starting at i just after the % and returns the end and the character of
+// the verb.
+func scanVerb(format string, i int) (int, rune, bool) {
+	// Flags
+	for i < len(format) && strings.IndexByte("+-# 0", format[i]) >= 0 {
+		i++
+	}
+	// Argument indexes, width and precision
+	for i < len(format) {
+		c := format[i]
+		switch {
+		case c >= '0' && c <= '9', c == '*', c == '.':
+			i++
+		case c == '[':
+			end := strings.IndexByte(format[i:], ']')
+			if end < 0 {
+				return 0, 0, false
+			}
+			i += end + 1
+		default:
+			verb, size := utf8.DecodeRuneInString(format[i:])
+			return i + size, verb, true
+		}
+	}
+	return 0, 0, false
+}
+
+// verbArg returns the index of the argument formatted by the verb raw and
+// the index of the next argument, following explicit argument indexes and
+// the arguments consumed by * for width and precision. The index is -1 if
+// the verb has a bad argument index such as %[0]d, which fmt prints as
+// %!d(BADINDEX) without formatting an argument.
+func verbArg(raw string, argNum int) (int, int) {
+	bad := false
+	for i := 1; i < len(raw)-1; i++ {
+		switch raw[i] {
+		case '[':
+			end := strings.IndexByte(raw[i:], ']')
+			if n, err := strconv.Atoi(raw[i+1 : i+end]); err == nil && n >= 1 {
+				argNum = n - 1
+			} else {
+				bad = true
+			}
+			i += end
+		case '*':
+			argNum++
+		}
+	}
+	if bad {
+		return -1, argNum
+	}
+	return argNum, argNum + 1
+}
+
+// formatArg formats a constant argument with the verb. It reports false if
+// the verb takes its width or precision from another argument or cannot
+// format the value.
+func formatArg(verb *formatVerb, value constant.Value) (string, bool) {
+	if strings.Contains(verb.raw, "*") {
+		return "", false
+	}
+
+	var arg any
+	switch value.Kind() {
+	case constant.String:
+		arg = constant.StringVal(value)
+	case constant.Int:
+		n, ok := constant.Int64Val(value)
+		if !ok {
+			return "", false
+		}
+		arg = n
+	case constant.Float:
+		f, _ := constant.Float64Val(value)
+		arg = f
+	case constant.Bool:
+		arg = constant.BoolVal(value)
+	default:
+		return "", false
+	}
+
+	formatted := fmt.Sprintf(argIndexPattern.ReplaceAllString(verb.raw, ""), arg)
+	if strings.Contains(formatted, "%!") {
+		return "", false
+	}
+	return formatted, true
+}
+
+// newNonce returns a random number that does not appear in sql, so that the
+// placeholders built from it cannot collide with the original query.
+func newNonce(sql string) int {
+	for {
+		nonce := 100000 + rand.Intn(900000)
+		if !strings.Contains(sql, strconv.Itoa(nonce)) {
+			return nonce
+		}
+	}
+}
+
+// placeholder returns the unique token the i-th verb is replaced with before
+// the SQL is passed to the command. The token keeps the shape of the value
+// the verb formats so that the SQL stays parsable.
+func placeholder(verb rune, nonce, i int) string {
+	switch verb {
+	case 'd', 'b', 'o', 'O', 'x', 'X', 'c', 'U', 'e', 'E', 'f', 'F', 'g', 'G':
+		return fmt.Sprintf("-999%d%04d", nonce, i)
+	case 's':
+		return fmt.Sprintf("_DUMMY_STRING_%d_%d_", nonce, i)
+	case 'q':
+		return fmt.Sprintf(`"_DUMMY_QUOTED_%d_%d_"`, nonce, i)
+	default:
+		return fmt.Sprintf("_DUMMY_VALUE_%d_%d_", nonce, i)
+	}
+}
+
+// fillFormatVerbs replaces each verb of a format string with a unique
+// placeholder built from nonce and returns the verbs in order of appearance.
+func fillFormatVerbs(sql string, nonce int) (string, []*formatVerb) {
+	verbs := make([]*formatVerb, 0)
+	filled := fillFormatArgs(sql, nil, func(verb *formatVerb, _ string) string {
+		verb.placeholder = placeholder(verb.verb, nonce, len(verbs))
+		verbs = append(verbs, verb)
+		return verb.placeholder
+	})
+	return filled, verbs
+}
+
+// fillFormatArgs replaces each verb of a format string with its argument
+// formatted when args holds a constant value for it, and with the value
+// fill returns for the verb and the literal text before it otherwise.
+func fillFormatArgs(sql string, args []constant.Value, fill func(verb *formatVerb, before string) string) string {
+	var b strings.Builder
+	// before is the literal text before the current verb.
+	var before strings.Builder
+	for _, part := range parseFormat(sql) {
+		if part.verb == nil {
+			b.WriteString(part.text)
+			before.WriteString(part.text)
+			continue
+		}
+		if part.verb.arg >= 0 && part.verb.arg < len(args) && args[part.verb.arg] != nil {
+			if formatted, ok := formatArg(part.verb, args[part.verb.arg]); ok {
+				b.WriteString(formatted)
+				continue
+			}
+		}
+		b.WriteString(fill(part.verb, before.String()))
+	}
+	return b.String()
+}
+
+// restoreFormatVerbs replaces the placeholders in sql with the verbs they
+// were filled for and escapes % so that sql is a format string again.
+// Every placeholder must appear exactly once.
+func restoreFormatVerbs(sql string, verbs []*formatVerb) (string, error) {
+	for i, verb := range verbs {
+		switch n := strings.Count(sql, verb.placeholder); n {
+		case 1:
+		case 0:
+			return "", fmt.Errorf("placeholder %s for verb #%d %s is missing in the command output", verb.placeholder, i+1, verb.raw)
+		default:
+			return "", fmt.Errorf("placeholder %s for verb #%d %s appears %d times in the command output", verb.placeholder, i+1, verb.raw, n)
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(sql); {
+		restored := false
+		for _, verb := range verbs {
+			if !strings.HasPrefix(sql[i:], verb.placeholder) {
+				continue
+			}
+			b.WriteString(verb.raw)
+			i += len(verb.placeholder)
+			restored = true
+			break
+		}
+		if restored {
+			continue
+		}
+		b.WriteString(escapePercent(sql[i : i+1]))
+		i++
+	}
+	return b.String(), nil
+}
+
+// escapePercent escapes % in literal text of a format string.
+func escapePercent(s string) string {
+	return strings.ReplaceAll(s, "%", "%%")
+}
+
+// maxArgCombinations is the maximum number of queries linted for a Sprintf
+// with arguments that can take several constant values.
+const maxArgCombinations = 16
+
+// argCombinations returns the combinations of constant values args can take
+// together. An argument is left nil, and replaced with a placeholder, if its
+// value is unknown, or if it can take several values and expand is false.
+func argCombinations(args [][]constant.Value, expand bool) [][]constant.Value {
+	combinations := [][]constant.Value{make([]constant.Value, len(args))}
+	for i, values := range args {
+		switch {
+		case len(values) == 1:
+			for _, combination := range combinations {
+				combination[i] = values[0]
+			}
+		case len(values) > 1 && expand && len(combinations)*len(values) <= maxArgCombinations:
+			expanded := make([][]constant.Value, 0, len(combinations)*len(values))
+			for _, combination := range combinations {
+				for _, value := range values {
+					c := append([]constant.Value{}, combination...)
+					c[i] = value
+					expanded = append(expanded, c)
+				}
+			}
+			combinations = expanded
+		}
+	}
+	return combinations
+}